@@ -0,0 +1,162 @@
+package doproxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connection tracking
+//
+// every proxied request counts as active connection until the upstream
+// is finished, this includes long downloads, websockets and event
+// streams, the transferred bytes are counted per user, a proxy is idle
+// only without active connections
+
+type proxy_activity struct {
+	inflight  int64 // active connections
+	bytes_in  int64 // bytes received from the clients
+	bytes_out int64 // bytes sent to the clients
+	last_end  int64 // end of the last connection in unix nanoseconds
+	draining  int32 // 1 while the container is drained or paused
+	wake      sync.Mutex
+}
+
+func (a *proxy_activity) begin() {
+	if a != nil {
+		atomic.AddInt64(&a.inflight, 1)
+	}
+}
+
+func (a *proxy_activity) end() {
+	if a != nil {
+		atomic.StoreInt64(&a.last_end, time.Now().UnixNano())
+		atomic.AddInt64(&a.inflight, -1)
+	}
+}
+
+// start_drain marks the entry as draining, only the first caller gets
+// true and has to drain the container
+func (a *proxy_activity) start_drain() bool {
+	return a != nil && atomic.CompareAndSwapInt32(&a.draining, 0, 1)
+}
+
+func (a *proxy_activity) stop_drain() {
+	if a != nil {
+		atomic.StoreInt32(&a.draining, 0)
+	}
+}
+
+func (a *proxy_activity) is_draining() bool {
+	return a != nil && atomic.LoadInt32(&a.draining) != 0
+}
+
+func (a *proxy_activity) active() int64 {
+	if a == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&a.inflight)
+}
+
+func (a *proxy_activity) bytes() (int64, int64) {
+	if a == nil {
+		return 0, 0
+	}
+	return atomic.LoadInt64(&a.bytes_in), atomic.LoadInt64(&a.bytes_out)
+}
+
+// idle returns the time since the last activity, active connections
+// are never idle
+func (a *proxy_activity) idle(last time.Time) time.Duration {
+	if a == nil {
+		return time.Since(last)
+	}
+	if a.active() > 0 {
+		return 0
+	}
+	if end := time.Unix(0, atomic.LoadInt64(&a.last_end)); end.After(last) {
+		last = end
+	}
+	return time.Since(last)
+}
+
+// counting_body counts the bytes of a request body
+type counting_body struct {
+	io.ReadCloser
+	counter *int64
+}
+
+func (b counting_body) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(b.counter, int64(n))
+	return n, err
+}
+
+// counting_conn counts the bytes of a hijacked connection (websockets)
+type counting_conn struct {
+	net.Conn
+	a *proxy_activity
+}
+
+func (c counting_conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.a.bytes_in, int64(n))
+	return n, err
+}
+
+func (c counting_conn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.a.bytes_out, int64(n))
+	return n, err
+}
+
+// counting_writer counts the bytes of a response, flushing and
+// hijacking are passed through for event streams and websockets
+type counting_writer struct {
+	http.ResponseWriter
+	a *proxy_activity
+}
+
+func (w counting_writer) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	atomic.AddInt64(&w.a.bytes_out, int64(n))
+	return n, err
+}
+
+func (w counting_writer) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w counting_writer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can't be hijacked")
+	}
+	conn, rw, err := h.Hijack()
+	if err != nil {
+		return conn, rw, err
+	}
+	return counting_conn{Conn: conn, a: w.a}, rw, nil
+}
+
+func (w counting_writer) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// track_request wraps a request and its response writer for the counters
+func (a *proxy_activity) track_request(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request) {
+	if a == nil {
+		return w, r
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = counting_body{ReadCloser: r.Body, counter: &a.bytes_in}
+	}
+	return counting_writer{ResponseWriter: w, a: a}, r
+}
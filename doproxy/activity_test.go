@@ -0,0 +1,54 @@
+package doproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestActivityIdle(t *testing.T) {
+	last := time.Now().Add(-time.Hour)
+
+	var none *proxy_activity
+	if idle := none.idle(last); idle < time.Hour {
+		t.Errorf("idle without activity = %v, want the time since the last request", idle)
+	}
+
+	// an active connection is never idle
+	a := &proxy_activity{}
+	a.begin()
+	if idle := a.idle(last); idle != 0 {
+		t.Errorf("idle with an active connection = %v, want 0", idle)
+	}
+
+	// the end of a long connection counts as the last activity
+	a.end()
+	if idle := a.idle(last); idle > time.Minute {
+		t.Errorf("idle after the end of a connection = %v, want about 0", idle)
+	}
+	if a.active() != 0 {
+		t.Errorf("active = %d, want 0", a.active())
+	}
+}
+
+func TestActivityBytes(t *testing.T) {
+	a := &proxy_activity{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, "hello world")
+	})
+
+	r := httptest.NewRequest("POST", "/", strings.NewReader("12345"))
+	w, r := a.track_request(httptest.NewRecorder(), r)
+	handler.ServeHTTP(w, r)
+
+	if bytes_in, bytes_out := a.bytes(); bytes_in != 5 || bytes_out != 11 {
+		t.Errorf("bytes = %d in, %d out, want 5 in, 11 out", bytes_in, bytes_out)
+	}
+	if _, ok := w.(http.Flusher); !ok {
+		t.Errorf("the tracked response writer can't be flushed")
+	}
+}
@@ -0,0 +1,75 @@
+package doproxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// admin interface
+//
+// the admin requests are only available if a token is configured, the
+// token is sent as bearer token in the Authorization header
+
+var admin_token string = ""
+
+func init_admin(data map[interface{}]interface{}) {
+	admin_token = config_string(config_section(data, "admin"), "token", "")
+	if admin_token == "" {
+		log.Printf("No admin token configured, admin requests are disabled!")
+	}
+}
+
+func admin_authorized(r *http.Request) bool {
+	if admin_token == "" {
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(admin_token)) == 1
+}
+
+func send_json(w http.ResponseWriter, status int, resp interface{}) {
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("Error happened in JSON marshal. Err: %s", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonResp)
+}
+
+// Handle_admin_request
+//
+// POST /hrp/reset/<username>   resets the circuit breaker of a user
+// GET  /hrp/metrics            counters in the prometheus text format
+func Handle_admin_request(w http.ResponseWriter, r *http.Request) {
+	log.Printf("admin: %v %v - %v", r.Method, r.URL.Path, r.RemoteAddr)
+
+	if !admin_authorized(r) {
+		send_json(w, http.StatusForbidden, map[string]string{"message": "forbidden"})
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/hrp/")
+	switch {
+	case strings.HasPrefix(path, "reset/"):
+		if r.Method != http.MethodPost {
+			send_json(w, http.StatusMethodNotAllowed, map[string]string{"message": "use POST"})
+			return
+		}
+		username := strings.TrimPrefix(path, "reset/")
+		if breaker_reset(username, "an admin") {
+			send_json(w, http.StatusOK, map[string]string{"message": "reset", "user": username})
+		} else {
+			send_json(w, http.StatusNotFound, map[string]string{"message": "no open circuit", "user": username})
+		}
+	case path == "metrics":
+		handle_metrics(w)
+	default:
+		http.NotFound(w, r)
+	}
+}
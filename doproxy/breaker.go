@@ -0,0 +1,198 @@
+package doproxy
+
+import (
+	"errors"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// circuit breaker
+//
+// failures of a user container are counted, after breaker_failures
+// failures the circuit opens and no container is spawned until the
+// backoff is over, every further failure doubles the backoff, the
+// circuit is reset by a successful response, by an admin or by the
+// owner who creates the reset file in the public directory
+
+type breaker_state struct {
+	failures int
+	last     time.Time // time of the last failure
+	opened   time.Time // time when the circuit was opened
+	until    time.Time // end of the backoff
+	reason   string
+	checked  time.Time // last check of the reset file
+}
+
+var breakers sync.Map
+
+// failures of users which can't be resolved by the info provider are
+// not recorded, anybody can request any username
+var errUnknownUser = errors.New("unknown user")
+
+// last removal of the forgotten failures in unix seconds
+var breaker_pruned int64
+
+var breaker_failures int = 3
+var breaker_backoff int = 30
+var breaker_max_backoff int = 3600
+var breaker_forget int = 600
+var breaker_reset_file string = ".hrp-reset"
+
+func init_breaker(data map[interface{}]interface{}) {
+	section := config_section(data, "breaker")
+	breaker_failures = config_int(section, "failures", breaker_failures)
+	breaker_backoff = config_int(section, "backoff", breaker_backoff)
+	breaker_max_backoff = config_int(section, "max_backoff", breaker_max_backoff)
+	breaker_forget = config_int(section, "forget", breaker_forget)
+	breaker_reset_file = config_string(section, "reset_file", breaker_reset_file)
+}
+
+func load_breaker(username string) (breaker_state, bool) {
+	if result, ok := breakers.Load(username); ok {
+		return result.(breaker_state), true
+	}
+	return breaker_state{}, false
+}
+
+// breaker_failure records a failure of a user container
+func breaker_failure(username string, reason string) {
+	if username == "" || breaker_failures <= 0 {
+		return
+	}
+	breaker_prune()
+	state, _ := load_breaker(username)
+
+	// old failures are forgotten
+	if time.Since(state.last) > time.Duration(breaker_forget)*time.Second {
+		state.failures = 0
+	}
+	state.failures++
+	state.last = time.Now()
+	state.reason = reason
+
+	if state.failures >= breaker_failures {
+		exponent := float64(state.failures - breaker_failures)
+		backoff := math.Min(float64(breaker_backoff)*math.Pow(2, exponent), float64(breaker_max_backoff))
+		if state.opened.IsZero() {
+			state.opened = time.Now()
+		}
+		state.until = time.Now().Add(time.Duration(backoff) * time.Second)
+		log.Printf("Circuit for '%s' is open for %.0f seconds (%d failures, %s)",
+			username, backoff, state.failures, reason)
+	} else {
+		log.Printf("Failure %d of %d for '%s' (%s)", state.failures, breaker_failures, username, reason)
+	}
+	breakers.Store(username, state)
+}
+
+// breaker_prune removes the entries with forgotten failures and an
+// expired backoff, at most once per forget period
+func breaker_prune() {
+	now := time.Now().Unix()
+	last := atomic.LoadInt64(&breaker_pruned)
+	if now-last < int64(breaker_forget) || !atomic.CompareAndSwapInt64(&breaker_pruned, last, now) {
+		return
+	}
+	breakers.Range(func(key any, value any) bool {
+		state := value.(breaker_state)
+		if time.Since(state.last) > time.Duration(breaker_forget)*time.Second && time.Now().After(state.until) {
+			breakers.Delete(key)
+		}
+		return true
+	})
+}
+
+// breaker_success closes the circuit of a user
+func breaker_success(username string) {
+	if _, ok := breakers.Load(username); ok {
+		breakers.Delete(username)
+		log.Printf("Circuit for '%s' is closed!", username)
+	}
+}
+
+// breaker_reset is called by an admin or the owner
+func breaker_reset(username string, by string) bool {
+	if _, ok := breakers.Load(username); !ok {
+		return false
+	}
+	breakers.Delete(username)
+	log.Printf("Circuit for '%s' was reset by %s!", username, by)
+	return true
+}
+
+// breaker_open checks if no container should be spawned for a user,
+// after the backoff one attempt is allowed (half-open)
+func breaker_open(username string) (bool, breaker_state) {
+	state, ok := load_breaker(username)
+	if !ok || state.until.IsZero() {
+		return false, state
+	}
+	if time.Now().After(state.until) {
+		return false, state
+	}
+	if owner_reset(username, &state) {
+		return false, state
+	}
+	return true, state
+}
+
+// owner_reset checks (at most every 30 seconds) if the owner created
+// the reset file in the public directory after the circuit was opened
+func owner_reset(username string, state *breaker_state) bool {
+	if breaker_reset_file == "" || time.Since(state.checked) < 30*time.Second {
+		return false
+	}
+	state.checked = time.Now()
+	breakers.Store(username, *state)
+
+	infos, err := info_func(username)
+	if err != nil {
+		return false
+	}
+	public := infos.public
+	if public == "" {
+		if public, err = FindPublicDirectory(infos.home); err != nil {
+			return false
+		}
+	}
+	proxy_path, _ := translate_path(filepath.Join(public, breaker_reset_file))
+	finfo, err := os.Stat(proxy_path)
+	if err != nil || finfo.ModTime().Before(state.opened) {
+		return false
+	}
+	return breaker_reset(username, "the owner")
+}
+
+type unavailable_page struct {
+	Username string
+	Retry    int
+}
+
+// send_unavailable_page
+//
+// sends the "site temporarily unavailable" page while the circuit is open
+func send_unavailable_page(w http.ResponseWriter, username string, state breaker_state) {
+	retry := int(time.Until(state.until).Seconds()) + 1
+
+	tmpl, err := template.ParseFiles("templates/unavailable.html")
+	if err != nil {
+		log.Print(err.Error())
+		http.Error(w, http.StatusText(503), 503)
+		return
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	err = tmpl.ExecuteTemplate(w, "layout", unavailable_page{Username: username, Retry: retry})
+	if err != nil {
+		log.Print(err.Error())
+	}
+}
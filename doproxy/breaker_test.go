@@ -0,0 +1,67 @@
+package doproxy
+
+import (
+	"testing"
+	"time"
+)
+
+// with_breaker_config sets the breaker settings for a test
+func with_breaker_config(t *testing.T, failures int, backoff int, max_backoff int) {
+	old_failures, old_backoff, old_max, old_file := breaker_failures, breaker_backoff, breaker_max_backoff, breaker_reset_file
+	t.Cleanup(func() {
+		breaker_failures, breaker_backoff, breaker_max_backoff, breaker_reset_file = old_failures, old_backoff, old_max, old_file
+	})
+	breaker_failures = failures
+	breaker_backoff = backoff
+	breaker_max_backoff = max_backoff
+	breaker_reset_file = ""
+}
+
+func TestBreakerBackoff(t *testing.T) {
+	with_breaker_config(t, 3, 30, 100)
+	username := "breaker_backoff"
+	t.Cleanup(func() { breakers.Delete(username) })
+
+	// the backoff after every failure, 0 means closed
+	backoffs := []int{0, 0, 30, 60, 100, 100}
+	for i, backoff := range backoffs {
+		breaker_failure(username, "test")
+		open, state := breaker_open(username)
+		if backoff == 0 {
+			if open {
+				t.Errorf("failure %d: circuit is open, want closed", i+1)
+			}
+			continue
+		}
+		if !open {
+			t.Errorf("failure %d: circuit is closed, want open", i+1)
+			continue
+		}
+		if got := state.until.Sub(state.last).Round(time.Second); got != time.Duration(backoff)*time.Second {
+			t.Errorf("failure %d: backoff %v, want %ds", i+1, got, backoff)
+		}
+	}
+
+	breaker_success(username)
+	if open, _ := breaker_open(username); open {
+		t.Errorf("circuit is open after a success")
+	}
+}
+
+func TestBreakerForget(t *testing.T) {
+	with_breaker_config(t, 2, 30, 100)
+	username := "breaker_forget"
+	t.Cleanup(func() { breakers.Delete(username) })
+
+	// an old failure is forgotten, the next one is the first again
+	breakers.Store(username, breaker_state{failures: 1, last: time.Now().Add(-time.Duration(breaker_forget+1) * time.Second)})
+	breaker_failure(username, "test")
+	if open, state := breaker_open(username); open || state.failures != 1 {
+		t.Errorf("open = %v with %d failures, want closed with 1 failure", open, state.failures)
+	}
+
+	breaker_failure(username, "test")
+	if open, state := breaker_open(username); !open || state.failures != 2 {
+		t.Errorf("open = %v with %d failures, want open with 2 failures", open, state.failures)
+	}
+}
@@ -0,0 +1,194 @@
+package doproxy
+
+import (
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// capacity limit
+//
+// the number of running containers and the sum of their memory limits
+// can be limited, a spawn beyond the capacity evicts the least recently
+// used idle container, without any candidate the spawn waits up to
+// queue_timeout seconds and gets the "server busy" page afterwards
+
+var capacity_max_containers int = 0
+var capacity_memory_budget int64 = 0
+var capacity_queue_timeout int = 10
+
+var errBusy = errors.New("server busy")
+
+// memory of the spawns between acquire_capacity and release_capacity,
+// the entries of these spawns are not ready yet
+var capacity_reservations = map[string]int64{}
+var capacity_lock sync.Mutex
+
+func init_capacity(data map[interface{}]interface{}) {
+	section := config_section(data, "capacity")
+	capacity_max_containers = config_int(section, "max_containers", capacity_max_containers)
+	capacity_memory_budget = config_size(section, "memory_budget", capacity_memory_budget)
+	capacity_queue_timeout = config_int(section, "queue_timeout", capacity_queue_timeout)
+
+	if capacity_max_containers > 0 || capacity_memory_budget > 0 {
+		log.Printf("Capacity: max %d containers, memory budget %d bytes", capacity_max_containers, capacity_memory_budget)
+	}
+}
+
+// uses_capacity checks if a proxy entry holds a running container, the
+// spawns in progress are counted by their reservations
+func uses_capacity(pe proxy_service) bool {
+	return pe.ready && pe.state != state_stopped && pe.state != state_dead
+}
+
+// capacity_usage returns the number of running containers and the sum
+// of their memory limits including the reservations, the entry of
+// username is not counted
+func capacity_usage(username string) (int, int64) {
+	capacity_lock.Lock()
+	defer capacity_lock.Unlock()
+	return capacity_count(username)
+}
+
+// capacity_count is capacity_usage, the lock must be held
+func capacity_count(username string) (int, int64) {
+	count, memory := 0, int64(0)
+	proxies.Range(func(key any, value any) bool {
+		pe := value.(proxy_service)
+		if key.(string) != username && uses_capacity(pe) {
+			count++
+			memory += pe.memory
+		}
+		return true
+	})
+	for key, reserved := range capacity_reservations {
+		if key != username {
+			count++
+			memory += reserved
+		}
+	}
+	return count, memory
+}
+
+func capacity_available(username string, memory int64) bool {
+	capacity_lock.Lock()
+	defer capacity_lock.Unlock()
+	return capacity_free(username, memory)
+}
+
+// capacity_free checks the capacity, the lock must be held
+func capacity_free(username string, memory int64) bool {
+	count, used := capacity_count(username)
+	if capacity_max_containers > 0 && count >= capacity_max_containers {
+		return false
+	}
+	if capacity_memory_budget > 0 && used+memory > capacity_memory_budget {
+		return false
+	}
+	return true
+}
+
+// lru_candidate returns the idle container which was used least recently
+func lru_candidate(username string) (string, proxy_service, bool) {
+	var candidate string
+	var result proxy_service
+	var max_idle time.Duration = -1
+
+	proxies.Range(func(key any, value any) bool {
+		pe := value.(proxy_service)
+		if key.(string) == username || !pe.ready || pe.activity.is_draining() || pe.pinned || !uses_capacity(pe) {
+			return true
+		}
+		if pe.activity.active() > 0 {
+			return true
+		}
+		if idle := pe.activity.idle(pe.last); idle > max_idle {
+			candidate, result, max_idle = key.(string), pe, idle
+		}
+		return true
+	})
+	return candidate, result, max_idle >= 0
+}
+
+// try_reserve reserves the memory for a spawn, if the capacity is free
+func try_reserve(username string, memory int64) bool {
+	capacity_lock.Lock()
+	defer capacity_lock.Unlock()
+	if !capacity_free(username, memory) {
+		return false
+	}
+	capacity_reservations[username] = memory
+	return true
+}
+
+// release_capacity removes the reservation of a spawn, after the entry
+// is ready or the spawn failed
+func release_capacity(username string) {
+	capacity_lock.Lock()
+	delete(capacity_reservations, username)
+	capacity_lock.Unlock()
+}
+
+// acquire_capacity waits until a container with the memory limit can be
+// started and reserves it, least recently used containers are evicted,
+// without evict only the free capacity is reserved and nothing waits
+func acquire_capacity(username string, memory int64, evict bool) error {
+	if capacity_max_containers <= 0 && capacity_memory_budget <= 0 {
+		return nil
+	}
+	if !evict {
+		if try_reserve(username, memory) {
+			return nil
+		}
+		return errBusy
+	}
+
+	deadline := time.Now().Add(time.Duration(capacity_queue_timeout) * time.Second)
+	queued := false
+	for {
+		if try_reserve(username, memory) {
+			return nil
+		}
+		if candidate, pe, ok := lru_candidate(username); ok {
+			if !pe.activity.start_drain() {
+				continue
+			}
+			log.Printf("Capacity reached, evicting container of '%s' for '%s'", candidate, username)
+			count_metric(&metric_evictions)
+			drain_container(candidate, pe)
+			continue
+		}
+		if !queued {
+			log.Printf("Capacity reached, spawn for '%s' is queued ...", username)
+			count_metric(&metric_queued)
+			queued = true
+		}
+		if time.Now().After(deadline) {
+			count_metric(&metric_busy)
+			return errBusy
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// send_busy_page
+//
+// sends the "server busy" page if no container can be started
+func send_busy_page(w http.ResponseWriter, username string) {
+	tmpl, err := template.ParseFiles("templates/busy.html")
+	if err != nil {
+		log.Print(err.Error())
+		http.Error(w, http.StatusText(503), 503)
+		return
+	}
+
+	w.Header().Set("Retry-After", "30")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	err = tmpl.ExecuteTemplate(w, "layout", username)
+	if err != nil {
+		log.Print(err.Error())
+	}
+}
@@ -0,0 +1,88 @@
+package doproxy
+
+import "testing"
+
+// with_capacity_config sets the capacity limits and the proxy entries
+// for a test
+func with_capacity_config(t *testing.T, max_containers int, memory_budget int64, entries []proxy_service) {
+	old_max, old_budget := capacity_max_containers, capacity_memory_budget
+	t.Cleanup(func() {
+		capacity_max_containers, capacity_memory_budget = old_max, old_budget
+		for _, pe := range entries {
+			proxies.Delete(pe.name)
+			release_capacity(pe.name)
+		}
+	})
+	capacity_max_containers = max_containers
+	capacity_memory_budget = memory_budget
+	for _, pe := range entries {
+		proxies.Store(pe.name, pe)
+	}
+}
+
+func TestCapacityUsage(t *testing.T) {
+	with_capacity_config(t, 0, 0, []proxy_service{
+		{name: "cap_running", ready: true, state: state_running, memory: 100},
+		{name: "cap_paused", ready: true, state: state_paused, memory: 200},
+		{name: "cap_stopped", ready: true, state: state_stopped, memory: 400},
+		{name: "cap_dead", state: state_dead, memory: 800},
+		{name: "cap_placeholder"},
+	})
+
+	// paused containers keep their memory, placeholders are counted by
+	// their reservations
+	if count, memory := capacity_usage(""); count != 2 || memory != 300 {
+		t.Errorf("usage = %d containers, %d bytes, want 2, 300", count, memory)
+	}
+	if count, memory := capacity_usage("cap_running"); count != 1 || memory != 200 {
+		t.Errorf("usage without cap_running = %d containers, %d bytes, want 1, 200", count, memory)
+	}
+}
+
+func TestTryReserve(t *testing.T) {
+	with_capacity_config(t, 3, 1000, []proxy_service{
+		{name: "cap_running", ready: true, state: state_running, memory: 400},
+		{name: "cap_first"},
+		{name: "cap_second"},
+		{name: "cap_third"},
+	})
+
+	if !try_reserve("cap_first", 500) {
+		t.Fatalf("cap_first didn't get a reservation")
+	}
+	if try_reserve("cap_second", 200) {
+		t.Errorf("cap_second exceeded the memory budget")
+	}
+	if !try_reserve("cap_second", 100) {
+		t.Fatalf("cap_second didn't get a reservation")
+	}
+	if try_reserve("cap_third", 0) {
+		t.Errorf("cap_third exceeded the maximum number of containers")
+	}
+
+	release_capacity("cap_first")
+	if !try_reserve("cap_third", 500) {
+		t.Errorf("cap_third didn't get the released capacity")
+	}
+	if count, memory := capacity_usage(""); count != 3 || memory != 1000 {
+		t.Errorf("usage = %d containers, %d bytes, want 3, 1000", count, memory)
+	}
+}
+
+func TestAcquireCapacityWithoutEviction(t *testing.T) {
+	with_capacity_config(t, 1, 0, []proxy_service{
+		{name: "cap_idle", ready: true, state: state_running, activity: &proxy_activity{}},
+		{name: "cap_prewarm"},
+	})
+
+	// a pre-warmed site never evicts the idle container
+	if err := acquire_capacity("cap_prewarm", 0, false); err != errBusy {
+		t.Errorf("acquire_capacity without eviction = %v, want %v", err, errBusy)
+	}
+	if result, ok := proxies.Load("cap_idle"); !ok || result.(proxy_service).activity.is_draining() {
+		t.Errorf("the idle container was evicted")
+	}
+	if lru, _, ok := lru_candidate("cap_prewarm"); !ok || lru != "cap_idle" {
+		t.Errorf("lru_candidate = %q, want cap_idle", lru)
+	}
+}
@@ -0,0 +1,142 @@
+package doproxy
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/docker/go-units"
+)
+
+// config helpers
+//
+// the configuration file is read into a generic yaml structure, these
+// helpers extract typed values from one section and fall back to a
+// default value if the key is not given
+
+func config_section(data map[interface{}]interface{}, name string) map[interface{}]interface{} {
+	if d, ok := data[name]; ok {
+		if section, ok2 := d.(map[interface{}]interface{}); ok2 {
+			return section
+		}
+		if d != nil {
+			log.Fatalf("Config: section '%s' must be a mapping", name)
+		}
+	}
+	return nil
+}
+
+func config_string(section map[interface{}]interface{}, key string, def string) string {
+	if d, ok := section[key]; ok && d != nil {
+		return fmt.Sprintf("%v", d)
+	}
+	return def
+}
+
+func config_int(section map[interface{}]interface{}, key string, def int) int {
+	if d, ok := section[key]; ok && d != nil {
+		n, ok2 := d.(int)
+		if !ok2 {
+			log.Fatalf("Config: '%s' must be an integer (got %v)", key, d)
+		}
+		return n
+	}
+	return def
+}
+
+func config_float(section map[interface{}]interface{}, key string, def float64) float64 {
+	if d, ok := section[key]; ok && d != nil {
+		switch n := d.(type) {
+		case int:
+			return float64(n)
+		case float64:
+			return n
+		default:
+			log.Fatalf("Config: '%s' must be a number (got %v)", key, d)
+		}
+	}
+	return def
+}
+
+func config_bool(section map[interface{}]interface{}, key string, def bool) bool {
+	if d, ok := section[key]; ok && d != nil {
+		b, ok2 := d.(bool)
+		if !ok2 {
+			log.Fatalf("Config: '%s' must be true or false (got %v)", key, d)
+		}
+		return b
+	}
+	return def
+}
+
+// config_strings accepts a list of values or a single value
+func config_strings(section map[interface{}]interface{}, key string) []string {
+	var result []string
+	if d, ok := section[key]; ok && d != nil {
+		switch l := d.(type) {
+		case []interface{}:
+			for _, v := range l {
+				result = append(result, fmt.Sprintf("%v", v))
+			}
+		default:
+			result = append(result, fmt.Sprintf("%v", l))
+		}
+	}
+	return result
+}
+
+func config_string_map(section map[interface{}]interface{}, key string) map[string]string {
+	result := make(map[string]string)
+	if d, ok := section[key]; ok && d != nil {
+		m, ok2 := d.(map[interface{}]interface{})
+		if !ok2 {
+			log.Fatalf("Config: '%s' must be a mapping", key)
+		}
+		for k, v := range m {
+			result[fmt.Sprintf("%v", k)] = fmt.Sprintf("%v", v)
+		}
+	}
+	return result
+}
+
+// config_list returns a list of mappings, e.g. the profile definitions
+func config_list(section map[interface{}]interface{}, key string) []map[interface{}]interface{} {
+	var result []map[interface{}]interface{}
+	if d, ok := section[key]; ok && d != nil {
+		l, ok2 := d.([]interface{})
+		if !ok2 {
+			log.Fatalf("Config: '%s' must be a list", key)
+		}
+		for _, v := range l {
+			m, ok3 := v.(map[interface{}]interface{})
+			if !ok3 {
+				log.Fatalf("Config: entries of '%s' must be mappings", key)
+			}
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// config_size reads memory sizes either as plain bytes or in the
+// docker notation like 512m or 2g
+func config_size(section map[interface{}]interface{}, key string, def int64) int64 {
+	if d, ok := section[key]; ok && d != nil {
+		switch n := d.(type) {
+		case int:
+			return int64(n)
+		case string:
+			if strings.TrimSpace(n) == "-1" {
+				return -1
+			}
+			size, err := units.RAMInBytes(n)
+			if err != nil {
+				log.Fatalf("Config: '%s' is not a valid size (%v)", key, err)
+			}
+			return size
+		default:
+			log.Fatalf("Config: '%s' must be a size like 512m (got %v)", key, d)
+		}
+	}
+	return def
+}
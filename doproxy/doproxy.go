@@ -13,7 +13,6 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"os"
 	"os/user"
 	"regexp"
 	"strings"
@@ -39,6 +38,15 @@ type proxy_service struct {
 	proxy        *httputil.ReverseProxy
 	start        time.Time
 	container_id string
+	profile      string
+	cull_timeout int             // in seconds, 0 means the global timeout
+	max_lifetime int             // in seconds, 0 means the global lifetime
+	pinned       bool            // never culled
+	state        string          // state of the container, see events.go
+	reason       string          // reason of the last state change
+	verified     time.Time       // last verification of the upstream
+	activity     *proxy_activity // shared by all copies of the entry
+	memory       int64           // memory limit of the container
 	// statistics
 	last  time.Time // time of last call
 	count int64     // number of calls
@@ -51,12 +59,14 @@ var proxies sync.Map // sync.Map automatically creates a map!
 
 var re *regexp.Regexp
 
-var info_func func(string) ([]string, error)
+var info_func func(string) (user_infos, error)
 
 // docker components
 var docker *client.Client
 var docker_image string = "registry.gitlab.com/ocordes/userwebsite:latest"
 var docker_network string = ""
+var docker_run_as_root bool = false
+var docker_supplementary_groups bool = false
 
 // culling components
 var Culling bool = false
@@ -68,6 +78,8 @@ var ldap_server string = ""
 var ldap_base string = ""
 var ldap_user_attr string = ""
 var ldap_directories_attr string = ""
+var ldap_group_attr string = ""
+var ldap_group_base string = ""
 
 // helper functions
 func extract_username(re *regexp.Regexp, s string) string {
@@ -106,8 +118,10 @@ func Init_doproxy() {
 		}
 	}
 
+	info_name := "passwd"
 	if d, ok := data["info"]; ok {
 		s := d.(string)
+		info_name = s
 		switch s {
 		case "ldap":
 			log.Printf("Using ldap connection!")
@@ -115,8 +129,14 @@ func Init_doproxy() {
 		case "passwd":
 			log.Printf("Using os password file!")
 			info_func = GetPasswdInfos
+		case "files":
+			log.Printf("Using password and group files!")
+			info_func = GetFilesInfos
+		case "pattern":
+			log.Printf("Using home directory pattern!")
+			info_func = GetPatternInfos
 		default:
-			log.Printf("Unknown info type '%s' given, only passwd|ldap are allowd", s)
+			log.Printf("Unknown info type '%s' given, only passwd|ldap|files|pattern are allowd", s)
 			log.Printf("Using os password file!")
 			info_func = GetPasswdInfos
 		}
@@ -144,7 +164,16 @@ func Init_doproxy() {
 		if n, ok2 := data["docker"].(map[interface{}]interface{})["network"]; ok2 {
 			docker_network = n.(string)
 		}
+		if n, ok2 := data["docker"].(map[interface{}]interface{})["run_as_root"]; ok2 {
+			docker_run_as_root = n.(bool)
+		}
+		if n, ok2 := data["docker"].(map[interface{}]interface{})["supplementary_groups"]; ok2 {
+			docker_supplementary_groups = n.(bool)
+		}
+	}
 
+	if docker_run_as_root {
+		log.Printf("User containers run with the user of the image!")
 	}
 
 	if _, ok := data["ldap"]; ok {
@@ -165,8 +194,44 @@ func Init_doproxy() {
 			ldap_directories_attr = n.(string)
 			log.Printf("Using LDAP directories-identifier: %s", ldap_directories_attr)
 		}
+		if n, ok2 := data["ldap"].(map[interface{}]interface{})["group_attr"]; ok2 {
+			ldap_group_attr = n.(string)
+			log.Printf("Using LDAP group-identifier: %s", ldap_group_attr)
+		}
+		if n, ok2 := data["ldap"].(map[interface{}]interface{})["group_base"]; ok2 {
+			ldap_group_base = n.(string)
+			log.Printf("Using LDAP group base: %s", ldap_group_base)
+		}
 	}
 
+	// the supplementary groups are the gidNumbers of the posix groups
+	// of the user
+	if info_name == "ldap" && docker_supplementary_groups && ldap_group_base == "" {
+		log.Fatalf("Config: supplementary_groups with ldap needs ldap.group_base")
+	}
+
+	init_resources(data)
+	init_profiles(data)
+	init_files(data)
+	init_paths(data)
+	init_public(data)
+	init_mounts(data)
+	init_security(data)
+	init_network(data)
+	init_labels(data)
+	init_state(data)
+	init_breaker(data)
+	init_admin(data)
+	init_upstream(data)
+	init_drain(data)
+	init_idle(data)
+	init_capacity(data)
+	init_policies(data)
+	init_windows(data)
+	init_prewarm(data)
+	init_pool(data)
+	init_pressure(data)
+
 	if d, ok := data["port"]; ok {
 		Server_port = d.(int)
 	}
@@ -195,7 +260,9 @@ func Init_doproxy() {
 	// copy the client variable
 	docker = cli
 
-	err = CreateNetwork(docker_network)
+	validate_paths()
+
+	err = setup_networks()
 
 	if err != nil {
 		log.Fatalln(err)
@@ -209,26 +276,48 @@ func Init_doproxy() {
 
 func Service_culling_range(username any, value any) bool {
 	pe := value.(proxy_service)
+	// spawns in progress are not culled, placeholders have no container
+	if pe.container_id == "" || pe.activity.is_draining() {
+		return true
+	}
+	// a dead container is removed after the timeout, even if it is
+	// pinned, the pinned service starts a new one
+	dead := pe.state == state_dead
+	if !dead && lifetime_exceeded(pe) {
+		if pe.activity.start_drain() {
+			go recycle_container(username.(string), pe)
+		}
+		return true
+	}
+	if pe.pinned && !dead {
+		return true
+	}
 	// tdiff := time.Now().Sub(pe.last).Seconds()
-	tdiff := float64(time.Since(pe.last).Seconds())
+	// active connections are never idle
+	tdiff := float64(pe.activity.idle(pe.last).Seconds())
 	//log.Printf("%s: count=%v last=%.1f container_id=%v", username, pe.count, tdiff, pe.container_id)
-	if tdiff > float64(Culling_timeout) {
+	timeout := culling_timeout(pe)
+	if tdiff > float64(timeout) {
 		log.Printf("Removing proxy for '%s' ...", username)
-		err := RemoveContainer(username.(string), pe.container_id)
-		if err != nil {
-			log.Printf("Removing container for '%s' failed (%v)", username, err.Error())
+		// the draining runs in the background, the other proxies are
+		// culled in the meantime, the entry is marked before
+		if pe.activity.start_drain() {
+			go drain_container(username.(string), pe)
 		}
-
-		// remove, even if the docker container failed to be removed, all other reactions
-		// will throw an error while reattaching ;-)
-		proxies.Delete(username)
+	} else if pe.ready {
+		// the idle tiers before the final timeout
+		idle_tiers(username.(string), pe, tdiff)
 	}
 	return true
 }
 
 func Service_culling() {
 	log.Printf("Culling service started ...")
+	if window, ok := active_window(); ok {
+		log.Printf("Culling window '%s' is active (timeout %ds)", window.name, window.timeout)
+	}
 	proxies.Range(Service_culling_range)
+	Service_pinned()
 	log.Printf("Culling service finished!")
 }
 
@@ -239,19 +328,16 @@ func Service_culling() {
 func Service_deep_culling() {
 	log.Printf("Deep culling service started ...")
 
-	containers, err := docker.ContainerList(context.Background(), types.ContainerListOptions{})
+	containers, err := ListUserContainers("", false)
 	if err != nil {
 		log.Printf("Can't read the list of running containers (%v)\n", err)
 		return
 	}
 
-	re := regexp.MustCompile("^/userwebsite_(.*?)$")
-
 	for _, container := range containers {
-		// extract the username from the container name
-		match := re.FindStringSubmatch(container.Names[0])
-		if match != nil {
-			username := match[1]
+		// extract the username from the container labels
+		username := container.Labels[label_user]
+		if username != "" {
 			if Debug {
 				log.Printf("webpage container found: %s", username)
 			}
@@ -273,26 +359,33 @@ func Service_deep_culling() {
 
 	}
 
+	collect_stopped_containers()
+
 	log.Printf("Deep culling service finished!")
 }
 
 // ldap related functions
-func GetLdapInfos(username string) ([]string, error) {
+func GetLdapInfos(username string) (user_infos, error) {
 	var directories []string
+	infos := user_infos{attributes: make(map[string][]string)}
 
 	log.Printf("Connecting to ldap...")
 
 	l, err := ldap.DialURL(ldap_server)
 	if err != nil {
-		return directories, err
+		return infos, err
 	}
 	defer l.Close()
 
-	attributes := []string{"dn", "cn", "homeDirectory"}
+	attributes := []string{"dn", "cn", "homeDirectory", "uidNumber", "gidNumber"}
 
 	if ldap_directories_attr != "" {
 		attributes = append(attributes, ldap_directories_attr)
 	}
+	if ldap_group_attr != "" {
+		attributes = append(attributes, ldap_group_attr)
+	}
+	attributes = append(attributes, profile_attributes()...)
 
 	searchRequest := ldap.NewSearchRequest(
 		ldap_base, // The base dn to search
@@ -305,12 +398,12 @@ func GetLdapInfos(username string) ([]string, error) {
 
 	sr, err := l.Search(searchRequest)
 	if err != nil {
-		return directories, err
+		return infos, err
 	}
 
 	if len(sr.Entries) == 0 {
 		newerr := errors.New("user not found")
-		return directories, newerr
+		return infos, newerr
 	}
 
 	entry := sr.Entries[0]
@@ -327,9 +420,9 @@ func GetLdapInfos(username string) ([]string, error) {
 	// check if everything is OK
 
 	// check for home directory
-	homedir := entry.GetAttributeValue("homeDirectory") + "/public_html"
-
-	directories = append(directories, homedir)
+	infos.home = entry.GetAttributeValue("homeDirectory")
+	infos.uid = entry.GetAttributeValue("uidNumber")
+	infos.gid = entry.GetAttributeValue("gidNumber")
 
 	if ldap_directories_attr != "" {
 		for _, dir := range entry.GetAttributeValues(ldap_directories_attr) {
@@ -337,24 +430,93 @@ func GetLdapInfos(username string) ([]string, error) {
 		}
 	}
 
+	// groups are given either as plain names or as DNs like
+	// cn=staff,ou=Groups,...
+	if ldap_group_attr != "" {
+		for _, group := range entry.GetAttributeValues(ldap_group_attr) {
+			if dn, err := ldap.ParseDN(group); err == nil && len(dn.RDNs) > 0 && len(dn.RDNs[0].Attributes) > 0 {
+				group = dn.RDNs[0].Attributes[0].Value
+			}
+			infos.groups = append(infos.groups, group)
+		}
+	}
+
+	if docker_supplementary_groups {
+		gids, err := ldap_group_ids(l, username, entry.DN, infos.gid)
+		if err != nil {
+			return infos, err
+		}
+		infos.gids = gids
+	}
+
+	for _, attr := range profile_attributes() {
+		infos.attributes[attr] = entry.GetAttributeValues(attr)
+	}
+
+	infos.directories = directories
+
 	log.Printf("ldap info complete!")
 
-	return directories, nil
+	return infos, nil
+}
+
+// ldap_group_ids returns the gidNumbers of the posix groups below
+// group_base, which list the user as a member, without the primary group
+func ldap_group_ids(l *ldap.Conn, username string, dn string, gid string) ([]string, error) {
+	searchRequest := ldap.NewSearchRequest(
+		ldap_group_base,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf("(|(memberUid=%s)(member=%s))", ldap.EscapeFilter(username), ldap.EscapeFilter(dn)),
+		[]string{"gidNumber"},
+		nil,
+	)
+
+	sr, err := l.Search(searchRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	var gids []string
+	for _, entry := range sr.Entries {
+		if n := entry.GetAttributeValue("gidNumber"); n != "" && n != gid {
+			gids = append(gids, n)
+		}
+	}
+	return gids, nil
 }
 
 // Passwd related functions
-func GetPasswdInfos(username string) ([]string, error) {
-	var directories []string
+func GetPasswdInfos(username string) (user_infos, error) {
+	infos := user_infos{attributes: make(map[string][]string)}
 
 	user_info, err := user.Lookup(username)
 
 	if err != nil {
-		return directories, err
+		return infos, err
 	}
 
-	directories = append(directories, user_info.HomeDir+"/public_html")
+	infos.home = user_info.HomeDir
+	infos.uid = user_info.Uid
+	infos.gid = user_info.Gid
 
-	return directories, nil
+	// the groups are only needed for the profile matching and the
+	// supplementary groups of the container
+	if len(profiles) > 0 || docker_supplementary_groups {
+		gids, err := user_info.GroupIds()
+		if err != nil {
+			log.Printf("Can't read the groups of '%s' (%v)", username, err)
+		}
+		for _, gid := range gids {
+			if gid != user_info.Gid {
+				infos.gids = append(infos.gids, gid)
+			}
+			if group, err := user.LookupGroupId(gid); err == nil {
+				infos.groups = append(infos.groups, group.Name)
+			}
+		}
+	}
+
+	return infos, nil
 }
 
 // docker related functions
@@ -384,31 +546,77 @@ func CreateNetwork(network_name string) error {
 	return err
 }
 
-func TestExistingContainer(username string) (string, string, error) {
-	// get all running containers
-	containers, err := docker.ContainerList(context.Background(), types.ContainerListOptions{})
+// TestExistingContainer looks for a container of the user in any state,
+// stopped containers are started again, outdated or broken containers
+// are removed, an empty container id means that a new container has
+// to be created
+func TestExistingContainer(username string, hash string, image string) (string, string, error) {
+	// get all containers of the user
+	containers, err := ListUserContainers(username, true)
 	if err != nil {
-		log.Printf("Can't read the list of running containers (%v)\n", err)
+		log.Printf("Can't read the list of containers (%v)\n", err)
 		return "", "", err
 	}
-	// name must begin with / in contrast to the create process,
-	// which omits the /, don't know why!
-	name := fmt.Sprintf("/userwebsite_%s", username)
 	for _, container := range containers {
-		if container.Names[0] == name {
-			log.Printf("Container '%s' found!", name)
-			data, _ := docker.ContainerInspect(context.Background(), container.ID)
-
-			// extract the IP address depending on the network settings
-			var ip_addr string
-			if docker_network == "" {
-				ip_addr = data.NetworkSettings.IPAddress
-			} else {
-				ip_addr = data.NetworkSettings.Networks[docker_network].IPAddress
+		data, err := docker.ContainerInspect(context.Background(), container.ID)
+		if err != nil {
+			return "", "", err
+		}
+		log.Printf("Container '%s' found (state: %s, restarts: %d)!",
+			container.Names[0], data.State.Status, data.RestartCount)
+
+		if is_crash_loop(data) {
+			log.Printf("Container of '%s' is crash looping (restarts: %d, exit code: %d, error: %s)!",
+				username, data.RestartCount, data.State.ExitCode, data.State.Error)
+			check_oom(username, container.ID)
+			if err := RemoveContainer(username, container.ID); err != nil {
+				log.Printf("Removing container for '%s' failed (%v)", username, err)
+			}
+			return "", "", fmt.Errorf("container of '%s' is crash looping", username)
+		}
+
+		switch data.State.Status {
+		case "running", "restarting":
+			// docker restarts the container by itself
+			data, err = wait_for_running(container.ID)
+			if err != nil {
+				return "", "", err
+			}
+		case "paused":
+			log.Printf("Unpausing container of '%s' ...", username)
+			if err := docker.ContainerUnpause(context.Background(), container.ID); err != nil {
+				return "", "", err
+			}
+			data, err = wait_for_running(container.ID)
+			if err != nil {
+				return "", "", err
+			}
+		default:
+			// created, exited or dead
+			if data.State.Status == "dead" || is_outdated(data, hash, image) {
+				log.Printf("Removing %s container of '%s' ...", data.State.Status, username)
+				if err := RemoveContainer(username, container.ID); err != nil {
+					return "", "", err
+				}
+				continue
+			}
+			log.Printf("Starting %s container of '%s' ...", data.State.Status, username)
+			if err := docker.ContainerStart(context.Background(), container.ID, types.ContainerStartOptions{}); err != nil {
+				return "", "", err
 			}
+			data, err = wait_for_running(container.ID)
+			if err != nil {
+				return "", "", err
+			}
+		}
 
-			return ip_addr, container.ID, nil
+		// extract the address depending on the network settings
+		ip_addr := container_address(username, data)
+		if ip_addr == "" {
+			return "", "", fmt.Errorf("container of '%s' has no IP address", username)
 		}
+
+		return ip_addr, container.ID, nil
 	}
 
 	return "", "", nil
@@ -419,28 +627,29 @@ func RemoveContainer(username string, container_id string) error {
 	if container_id == "" {
 		return errors.New("container_id is unset (Nil) and will not be removed")
 	}
+	expect_stop(container_id)
 	err := docker.ContainerStop(context.Background(), container_id, nil)
 	if err != nil {
 		return err
 	}
 	err = docker.ContainerRemove(context.Background(), container_id, types.ContainerRemoveOptions{})
+	if err == nil {
+		remove_user_network(username)
+	}
 	return err
 }
 
-func CheckHomedirectory(username string, directory string, mounts []mount.Mount) ([]mount.Mount, error) {
-	_, err := os.Stat(directory)
+func CheckHomedirectory(username string, home string, directory string, mounts []mount.Mount) ([]mount.Mount, error) {
+	host_path, err := check_public_directory(home, directory)
 
 	if err != nil {
+		audit_mount(username, directory, err)
 		return mounts, err
 	} else {
-		// is it necessary to check, if the directory is a directory?
-		//log.Printf("%v", finfo)
-		//log.Printf("%v", finfo.IsDir())
-		//log.Printf("%s", finfo.Name())
 		m := mount.Mount{
 			Type:     "bind",
-			Source:   directory,
-			Target:   fmt.Sprintf("/users/%s/public_html", username),
+			Source:   host_path,
+			Target:   strings.ReplaceAll(public_target, "{user}", username),
 			ReadOnly: false,
 		}
 		mounts = append(mounts, m)
@@ -449,46 +658,18 @@ func CheckHomedirectory(username string, directory string, mounts []mount.Mount)
 	return mounts, nil
 }
 
-func CheckAdditionalDirectories(directories []string, mounts []mount.Mount) []mount.Mount {
-	for _, dir := range directories {
-		s := strings.Split(dir, "::")
-		if Debug {
-			log.Printf("%s\n", dir)
-			log.Printf("%v\n", s)
-		}
-		// s[0] is the directory, s[1] is the readonly flag (if available)
-		is_ro := false
-		if len(s) > 1 {
-			is_ro = s[1] == "ro"
-		}
-
-		// check if directory is available
-		_, err := os.Stat(s[0])
-
-		if err != nil {
-			log.Printf("%s not found! (%v)", s[0], err.Error())
-		} else {
-			m := mount.Mount{
-				Type:     "bind",
-				Source:   s[0],
-				Target:   s[0],
-				ReadOnly: is_ro,
-			}
-			mounts = append(mounts, m)
-		}
-	}
-
-	return mounts
+// container_spec contains everything to create the container of a user
+type container_spec struct {
+	name          string
+	profile       site_profile
+	hash          string
+	config        *container.Config
+	hostConfig    *container.HostConfig
+	networkConfig *network.NetworkingConfig
 }
 
-func SpawnContainer(username string) (string, string, error) {
-	// check if container is already running
-	ip_addr, container_id, _ := TestExistingContainer(username)
-
-	if ip_addr != "" {
-		return ip_addr, container_id, nil
-	}
-
+// build_container collects the settings of the container of a user
+func build_container(username string) (container_spec, error) {
 	//var dirs []string
 	//var err error
 
@@ -501,23 +682,32 @@ func SpawnContainer(username string) (string, string, error) {
 	//	dirs, err = GetPasswdInfos(username)
 	//}
 
-	dirs, err := info_func(username)
+	infos, err := info_func(username)
 
 	if err != nil {
 		log.Printf("LDAP-Error: %v", err.Error())
-		return "", "", err
+		return container_spec{}, fmt.Errorf("%w: %v", errUnknownUser, err)
+	}
+	profile := select_profile(username, infos)
+
+	public := infos.public
+	if public == "" {
+		public, err = FindPublicDirectory(infos.home)
+		if err != nil {
+			return container_spec{profile: profile}, err
+		}
 	}
 
 	fmounts := []mount.Mount{}
 
-	fmounts, err = CheckHomedirectory(username, dirs[0], fmounts)
+	fmounts, err = CheckHomedirectory(username, infos.home, public, fmounts)
 	if err != nil {
-		return "", "", err
+		return container_spec{profile: profile}, err
 	}
 
 	// add additional directories to the mount array
-	if len(dirs) > 1 {
-		fmounts = CheckAdditionalDirectories(dirs[1:], fmounts)
+	if len(infos.directories) > 0 {
+		fmounts = CheckAdditionalDirectories(username, infos.directories, fmounts)
 	}
 
 	// mounts
@@ -530,9 +720,16 @@ func SpawnContainer(username string) (string, string, error) {
 	//}
 
 	// host config
+	user_spec, err := container_user(username, infos)
+	if err != nil {
+		return container_spec{profile: profile}, err
+	}
+
+	// containers stopped by the idle tiers or the culling stay stopped
+	// after a restart of the docker daemon
 	hostConfig := &container.HostConfig{
 		RestartPolicy: container.RestartPolicy{
-			Name: "always",
+			Name: "unless-stopped",
 		},
 		Mounts: fmounts,
 	}
@@ -545,39 +742,119 @@ func SpawnContainer(username string) (string, string, error) {
 	//	Gateway: "172.20.0.1",
 	//}
 	//networkConfig.EndpointsConfig[proxy_network] = gatewayConfig
-	networkConfig.EndpointsConfig[docker_network] = &network.EndpointSettings{}
+	networkConfig.EndpointsConfig[user_network(username)] = &network.EndpointSettings{}
 
-	name := fmt.Sprintf("userwebsite_%s", username)
+	err = prepare_user_network(username)
+	if err != nil {
+		log.Printf("Can't create the network for '%s': %v", username, err)
+		return container_spec{profile: profile}, err
+	}
+
+	name := container_name(username)
 
 	config := &container.Config{
 		//Image:        "registry.gitlab.com/ocordes/userwebsite",
-		Image:        docker_image,
-		Env:          []string{fmt.Sprintf("USERNAME=%s", username)},
+		Image:        profile.image,
+		Env:          append([]string{fmt.Sprintf("USERNAME=%s", username)}, profile.env...),
 		ExposedPorts: nil,
 		Hostname:     name,
+		User:         user_spec,
+	}
+
+	if docker_supplementary_groups && !docker_run_as_root {
+		hostConfig.GroupAdd = infos.gids
+	}
+
+	apply_resources(hostConfig, profile.resources)
+	apply_security(hostConfig)
+
+	// the hash is created before the labels are added
+	hash := config_hash(config, hostConfig)
+	config.Labels = container_labels(username, profile.name, hash)
+
+	return container_spec{
+		name:          name,
+		profile:       profile,
+		hash:          hash,
+		config:        config,
+		hostConfig:    hostConfig,
+		networkConfig: networkConfig,
+	}, nil
+}
+
+// create_container creates the container of a user without starting it
+func create_container(username string, spec container_spec) (string, error) {
+	container, err := docker.ContainerCreate(context.Background(), spec.config, spec.hostConfig, spec.networkConfig, nil, spec.name)
+	if err != nil {
+		return "", name_conflict(username, spec.name, err)
+	}
+
+	// the egress networks can only be joined after the creation
+	connect_egress_networks(username, container.ID)
+	return container.ID, nil
+}
+
+func SpawnContainer(username string, evict bool) (string, string, site_profile, error) {
+	record_spawn()
+
+	spec, err := build_container(username)
+	if err != nil {
+		return "", "", spec.profile, err
+	}
+	profile := spec.profile
+
+	// wait for a free slot, an existing container may be stopped
+	err = acquire_capacity(username, profile.resources.memory, evict)
+	if err != nil {
+		return "", "", profile, err
 	}
 
-	container, err := docker.ContainerCreate(context.Background(), config, hostConfig, networkConfig, nil, name)
+	// check if a container is already available
+	ip_addr, container_id, err := TestExistingContainer(username, spec.hash, profile.image)
+	if err != nil {
+		return "", "", profile, err
+	}
+	if container_id != "" {
+		pool_hit(username, container_id)
+		return ip_addr, container_id, profile, nil
+	}
 
+	container_id, err = create_container(username, spec)
 	if err != nil {
 		log.Printf("Error spawning new container: %v", err)
-		return "", "", err
+		return "", "", profile, err
 	}
 
 	// Run the created container
-	docker.ContainerStart(context.Background(), container.ID, types.ContainerStartOptions{})
-	log.Printf("Container for user %s is created: %s\n", username, container.ID)
+	err = docker.ContainerStart(context.Background(), container_id, types.ContainerStartOptions{})
+	if err == nil {
+		log.Printf("Container for user %s is created: %s (profile: %s)\n", username, container_id, profile.name)
+		ip_addr, err = spawn_address(username, container_id)
+	}
+	if err != nil {
+		// a broken container is not reused by the next spawn
+		log.Printf("Starting new container for '%s' failed (%v)", username, err)
+		if err := RemoveContainer(username, container_id); err != nil {
+			log.Printf("Removing container for '%s' failed (%v)", username, err)
+		}
+		return "", "", profile, err
+	}
 
-	data, _ := docker.ContainerInspect(context.Background(), container.ID)
+	return ip_addr, container_id, profile, nil
+}
 
-	// extract the IP address depending on the network settings
-	if docker_network == "" {
-		ip_addr = data.NetworkSettings.IPAddress
-	} else {
-		ip_addr = data.NetworkSettings.Networks[docker_network].IPAddress
+// spawn_address waits for the started container and extracts the
+// address depending on the network settings
+func spawn_address(username string, container_id string) (string, error) {
+	data, err := wait_for_running(container_id)
+	if err != nil {
+		return "", err
 	}
-
-	return ip_addr, container.ID, nil
+	ip_addr := container_address(username, data)
+	if ip_addr == "" {
+		return "", fmt.Errorf("container of '%s' has no IP address", username)
+	}
+	return ip_addr, nil
 }
 
 // NewProxy takes target host and creates a reverse proxy
@@ -603,6 +880,8 @@ func NewProxy(targetHost string) (*httputil.ReverseProxy, error) {
 // handler modifying responses
 func modifyResponse(res *http.Response) error {
 	log.Printf("%v -> %v (%v)", res.Status, res.Request.URL, res.Request.RemoteAddr)
+	// the container is answering
+	breaker_success(extract_username(re, res.Request.URL.Path))
 	return nil
 }
 
@@ -619,11 +898,32 @@ func modifyRequest(req *http.Request) {
 // the spawning methods take over the error handling
 func errorHandler() func(http.ResponseWriter, *http.Request, error) {
 	return func(w http.ResponseWriter, req *http.Request, err error) {
+		// the client aborted the request, the container is fine
+		if errors.Is(err, context.Canceled) {
+			if Debug {
+				log.Printf("Request aborted by the client: %v", req.URL.Path)
+			}
+			return
+		}
 		log.Printf("Got error while modifying response: %v \n", err)
 
-		// remove user from proxy list
 		username := extract_username(re, req.URL.Path)
-		proxies.Delete(username)
+		if result, ok := proxies.Load(username); ok {
+			// the address of the container may have changed
+			pe := result.(proxy_service)
+			old_url := pe.url
+			if pe, err := refresh_upstream(username, pe); err == nil && pe.url != old_url {
+				store_proxy(username, pe)
+				send_wait_page(w, username)
+				return
+			}
+			check_oom(username, pe.container_id)
+
+			// remove user from proxy list, unless it was respawned
+			delete_proxy(username, pe)
+		}
+
+		breaker_failure(username, err.Error())
 		// trigger a reload of the proxy
 		send_wait_page(w, username)
 	}
@@ -651,9 +951,12 @@ func send_wait_page(w http.ResponseWriter, s string) {
 	}
 }
 
-func create_proxy(s string) error {
+func create_proxy(s string, evict bool) error {
+	// the reservation of the spawn ends with the ready entry
+	defer release_capacity(s)
+
 	// spawn continer
-	ip_addr, container_id, err := SpawnContainer(s)
+	ip_addr, container_id, profile, err := SpawnContainer(s, evict)
 
 	if err != nil {
 		log.Printf("Can't create proxy service for:  %v (%v)", s, err.Error())
@@ -668,19 +971,32 @@ func create_proxy(s string) error {
 		return err
 	}
 
-	// update the proxy entry
-	result, _ := proxies.Load(s)
-	pe := result.(proxy_service)
+	// update the proxy entry, a removed placeholder is created again,
+	// so the new container is not lost
+	pe := proxy_service{name: s, activity: &proxy_activity{}}
+	if result, ok := proxies.Load(s); ok {
+		pe = result.(proxy_service)
+	} else {
+		log.Printf("Proxy entry of '%s' was removed during the spawn!", s)
+	}
 
 	// create a new entry
 	//pe := proxy_service{name: s, url: url, proxy: np, container_id: container_id, start: time.Now(), count: 0, last: time.Now()}
 	pe.url = url
 	pe.proxy = np
 	pe.container_id = container_id
+	pe.profile = profile.name
+	pe.cull_timeout = profile.cull_timeout
+	pe.max_lifetime = profile.max_lifetime
+	pe.pinned = profile.pinned
+	pe.memory = profile.resources.memory
 	pe.start = time.Now()
 	pe.count = 0
 	pe.last = time.Now()
 	pe.ready = true
+	pe.state = state_running
+	pe.reason = ""
+	pe.verified = time.Now()
 
 	proxies.Store(s, pe)
 
@@ -703,6 +1019,12 @@ func Handle_proxy_request(w http.ResponseWriter, r *http.Request) {
 
 	username := extract_username(re, r.URL.Path)
 	if username != "" {
+		// a dead container is spawned again
+		if result, ok := proxies.Load(username); ok && result.(proxy_service).state == state_dead {
+			log.Printf("Container of '%v' died (%v) -> respawning!", username, result.(proxy_service).reason)
+			delete_proxy(username, result.(proxy_service))
+		}
+
 		// check if we have already a defined proxy
 		if result, ok := proxies.Load(username); ok {
 			pe := result.(proxy_service)
@@ -710,30 +1032,75 @@ func Handle_proxy_request(w http.ResponseWriter, r *http.Request) {
 				// the proxy was called before the container was ready
 				log.Printf("Proxy for %v is starting -> send wait page!", username)
 				send_wait_page(w, username)
+			} else if pe.activity.is_draining() {
+				// the container is culled, the next reload spawns it again
+				log.Printf("Proxy for %v is draining -> send wait page!", username)
+				send_wait_page(w, username)
 			} else {
 				if Debug {
 					log.Printf("Proxy for %v is available -> redirecting to %v", username, pe.url)
 				}
-				pe.count += 1
-				pe.last = time.Now()
-				proxies.Store(username, pe)
-				pe.proxy.ServeHTTP(w, r)
+				// the request is active before the draining is checked
+				// again, so a drain either waits for this request or the
+				// request sees the drain
+				pe.activity.begin()
+				defer pe.activity.end()
+				if pe.activity.is_draining() {
+					log.Printf("Proxy for %v is draining -> send wait page!", username)
+					send_wait_page(w, username)
+					return
+				}
+				// paused or stopped containers are woken up
+				pe, err := wake_container(username, pe)
+				if errors.Is(err, errBusy) {
+					send_busy_page(w, username)
+					return
+				}
+				if err == nil {
+					pe, err = verify_upstream(username, pe)
+				}
+				if err != nil {
+					log.Printf("Upstream of '%v' is invalid (%v) -> respawning!", username, err)
+					delete_proxy(username, pe)
+					send_wait_page(w, username)
+					return
+				}
+				record_access(username)
+				prewarm_hit(username)
+				touch_proxy(username, pe)
+				tw, tr := pe.activity.track_request(w, r)
+				pe.proxy.ServeHTTP(tw, tr)
 				//http.NotFound(w, r)
 			}
+		} else if open, state := breaker_open(username); open {
+			log.Printf("Circuit for '%v' is open -> send unavailable page!", username)
+			send_unavailable_page(w, username, state)
 		} else {
 			log.Printf("Spwawning proxy for '%v' (%v) ...", username, r.URL.Path)
 
 			// create a new proxy entry, marking the container as not ready
-			proxy := proxy_service{name: username, ready: false}
-			proxies.Store(username, proxy)
+			proxy := proxy_service{name: username, ready: false, activity: &proxy_activity{}}
+			if _, loaded := proxies.LoadOrStore(username, proxy); loaded {
+				// a parallel request is already spawning the container
+				send_wait_page(w, username)
+				return
+			}
 
-			err := create_proxy(username)
-			if err != nil {
+			err := create_proxy(username, true)
+			if errors.Is(err, errBusy) {
+				delete_proxy(username, proxy)
+				send_busy_page(w, username)
+				log.Printf("Spawning aborted, server busy!")
+			} else if err != nil {
 				// remove proxy from list
-				proxies.Delete(username)
+				delete_proxy(username, proxy)
+				if !errors.Is(err, errUnknownUser) {
+					breaker_failure(username, err.Error())
+				}
 				http.Error(w, http.StatusText(500), 500)
 				log.Printf("Spawning aborted!")
 			} else {
+				record_access(username)
 				send_wait_page(w, username)
 				log.Printf("Spawning complete!")
 			}
@@ -0,0 +1,189 @@
+package doproxy
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// graceful culling
+//
+// a culled proxy is marked as draining, new requests get the wait page,
+// requests in flight may finish until the drain timeout, afterwards the
+// container is stopped with a grace period and optionally removed
+
+var cull_drain_timeout int = 30
+var cull_stop_grace int = 10
+var cull_remove bool = true
+var cull_keep_stopped int = 7 * 24 * 3600
+
+func init_drain(data map[interface{}]interface{}) {
+	section := config_section(data, "cull")
+	cull_drain_timeout = config_int(section, "drain_timeout", cull_drain_timeout)
+	cull_stop_grace = config_int(section, "stop_grace", cull_stop_grace)
+	cull_remove = config_bool(section, "remove", cull_remove)
+	cull_keep_stopped = config_int(section, "keep_stopped", cull_keep_stopped)
+}
+
+// drain_container stops routing to a container, waits for the requests
+// in flight and stops (and removes) the container, the caller must
+// have marked the entry with start_drain
+func drain_container(username string, pe proxy_service) {
+	bytes_in, bytes_out := pe.activity.bytes()
+	log.Printf("Culling '%s': %d requests, %d bytes in, %d bytes out", username, pe.count, bytes_in, bytes_out)
+
+	wait_for_drain(username, pe)
+	prewarm_culled(username)
+
+	// a paused container can't be stopped
+	if pe.state == state_paused {
+		docker.ContainerUnpause(context.Background(), pe.container_id)
+	}
+
+	err := stop_container(username, pe.container_id, cull_remove)
+	if err != nil {
+		log.Printf("Stopping container for '%s' failed (%v)", username, err.Error())
+	}
+
+	// remove, even if the docker container failed to be removed, all other reactions
+	// will throw an error while reattaching ;-)
+	delete_proxy(username, pe)
+}
+
+// the read-modify-write updates of the request path and the removal of
+// drained entries are serialized, a request can't restore a removed
+// entry
+var proxies_lock sync.Mutex
+
+// touch_proxy counts a request and keeps the verified upstream, if the
+// entry is still the same
+func touch_proxy(username string, pe proxy_service) {
+	proxies_lock.Lock()
+	defer proxies_lock.Unlock()
+	if result, ok := proxies.Load(username); ok && result.(proxy_service).activity == pe.activity {
+		current := result.(proxy_service)
+		current.url = pe.url
+		current.proxy = pe.proxy
+		current.verified = pe.verified
+		current.count += 1
+		current.last = time.Now()
+		proxies.Store(username, current)
+	}
+}
+
+// store_proxy stores a changed copy of the entry, if the entry is still
+// the same, the request statistics of the current entry are kept
+func store_proxy(username string, pe proxy_service) bool {
+	proxies_lock.Lock()
+	defer proxies_lock.Unlock()
+	result, ok := proxies.Load(username)
+	if !ok || result.(proxy_service).activity != pe.activity {
+		return false
+	}
+	current := result.(proxy_service)
+	pe.count = current.count
+	if current.last.After(pe.last) {
+		pe.last = current.last
+	}
+	proxies.Store(username, pe)
+	return true
+}
+
+// delete_proxy removes the entry, if it is still the same
+func delete_proxy(username string, pe proxy_service) {
+	proxies_lock.Lock()
+	defer proxies_lock.Unlock()
+	if result, ok := proxies.Load(username); ok && result.(proxy_service).activity == pe.activity {
+		proxies.Delete(username)
+	}
+}
+
+// wait_for_drain waits until the requests in flight are finished or
+// the drain timeout is reached
+func wait_for_drain(username string, pe proxy_service) {
+	deadline := time.Now().Add(time.Duration(cull_drain_timeout) * time.Second)
+	for pe.activity.active() > 0 && time.Now().Before(deadline) {
+		time.Sleep(250 * time.Millisecond)
+	}
+	if n := pe.activity.active(); n > 0 {
+		log.Printf("Drain timeout for '%s', %d requests still in flight!", username, n)
+	}
+}
+
+// stop_container stops a container with the grace period, the container
+// is removed if requested
+func stop_container(username string, container_id string, remove bool) error {
+	if container_id == "" {
+		return nil
+	}
+	check_oom(username, container_id)
+
+	grace := time.Duration(cull_stop_grace) * time.Second
+	expect_stop(container_id)
+	if err := docker.ContainerStop(context.Background(), container_id, &grace); err != nil {
+		return err
+	}
+	if !remove {
+		log.Printf("Container for '%s' stopped!", username)
+		return nil
+	}
+	err := docker.ContainerRemove(context.Background(), container_id, types.ContainerRemoveOptions{})
+	if err == nil {
+		remove_user_network(username)
+		log.Printf("Container for '%s' stopped and removed!", username)
+	}
+	return err
+}
+
+// collect_stopped_containers removes stopped containers without a proxy
+// entry after keep_stopped seconds, the containers of the warm pool are
+// managed by the pool
+func collect_stopped_containers() {
+	containers, err := ListUserContainers("", true)
+	if err != nil {
+		log.Printf("Can't read the list of containers (%v)", err)
+		return
+	}
+
+	removed := 0
+	for _, c := range containers {
+		username := c.Labels[label_user]
+		if username == "" || c.State == "running" || c.State == "paused" || c.State == "restarting" {
+			continue
+		}
+		if c.State == "created" && c.Labels[label_pool] != "" && Pool {
+			continue
+		}
+		if result, ok := proxies.Load(username); ok && result.(proxy_service).container_id == c.ID {
+			continue
+		}
+
+		data, err := docker.ContainerInspect(context.Background(), c.ID)
+		if err != nil || data.State == nil {
+			continue
+		}
+		stopped := time.Unix(c.Created, 0)
+		if finished, err := time.Parse(time.RFC3339Nano, data.State.FinishedAt); err == nil && finished.After(stopped) {
+			stopped = finished
+		}
+		if time.Since(stopped) < time.Duration(cull_keep_stopped)*time.Second {
+			continue
+		}
+
+		if err := docker.ContainerRemove(context.Background(), c.ID, types.ContainerRemoveOptions{}); err != nil {
+			log.Printf("Removing %s container of '%s' failed (%v)", c.State, username, err)
+			continue
+		}
+		remove_user_network(username)
+		removed++
+		if Debug {
+			log.Printf("Removed %s container of '%s' (stopped since %v)", c.State, username, stopped)
+		}
+	}
+	if removed > 0 {
+		log.Printf("%d stopped containers removed!", removed)
+	}
+}
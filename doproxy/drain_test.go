@@ -0,0 +1,101 @@
+package doproxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStartDrainOnce(t *testing.T) {
+	a := &proxy_activity{}
+
+	// only one of the parallel cullers drains the container
+	var winners int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if a.start_drain() {
+				atomic.AddInt32(&winners, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if winners != 1 || !a.is_draining() {
+		t.Fatalf("%d winners, draining %v, want 1 winner", winners, a.is_draining())
+	}
+
+	a.stop_drain()
+	if a.is_draining() || !a.start_drain() {
+		t.Errorf("drain can't be started again after stop_drain")
+	}
+
+	var none *proxy_activity
+	if none.start_drain() || none.is_draining() {
+		t.Errorf("an entry without activity is draining")
+	}
+}
+
+func TestWaitForDrain(t *testing.T) {
+	old := cull_drain_timeout
+	t.Cleanup(func() { cull_drain_timeout = old })
+	cull_drain_timeout = 5
+
+	pe := proxy_service{name: "wait_for_drain", activity: &proxy_activity{}}
+	pe.activity.begin()
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		pe.activity.end()
+	}()
+
+	start := time.Now()
+	wait_for_drain(pe.name, pe)
+	if pe.activity.active() != 0 {
+		t.Errorf("wait_for_drain returned with %d requests in flight", pe.activity.active())
+	}
+	if time.Since(start) >= time.Duration(cull_drain_timeout)*time.Second {
+		t.Errorf("wait_for_drain waited for the timeout")
+	}
+}
+
+func TestProxyIdentity(t *testing.T) {
+	username := "proxy_identity"
+	t.Cleanup(func() { proxies.Delete(username) })
+
+	old := proxy_service{name: username, ready: true, activity: &proxy_activity{}}
+	current := proxy_service{name: username, ready: true, activity: &proxy_activity{}, count: 5}
+	proxies.Store(username, current)
+
+	// a stale copy of a replaced entry changes nothing
+	touch_proxy(username, old)
+	if store_proxy(username, old) {
+		t.Errorf("store_proxy stored a stale entry")
+	}
+	delete_proxy(username, old)
+	result, ok := proxies.Load(username)
+	if !ok || result.(proxy_service).activity != current.activity || result.(proxy_service).count != 5 {
+		t.Fatalf("the current entry was changed by a stale copy")
+	}
+
+	touch_proxy(username, current)
+	if result, _ := proxies.Load(username); result.(proxy_service).count != 6 {
+		t.Errorf("count = %d, want 6", result.(proxy_service).count)
+	}
+
+	// the requests counted in the meantime are kept
+	refreshed := current
+	refreshed.url = "http://refreshed/"
+	if !store_proxy(username, refreshed) {
+		t.Fatalf("store_proxy didn't store the current entry")
+	}
+	if result, _ := proxies.Load(username); result.(proxy_service).count != 6 || result.(proxy_service).url != refreshed.url {
+		t.Errorf("count = %d, url = %q, want 6 and %q", result.(proxy_service).count, result.(proxy_service).url, refreshed.url)
+	}
+
+	delete_proxy(username, current)
+	if _, ok := proxies.Load(username); ok {
+		t.Errorf("the current entry was not removed")
+	}
+}
@@ -0,0 +1,162 @@
+package doproxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// docker events
+//
+// the events of the user containers update the proxy entries at once,
+// without waiting for a failing request
+
+const (
+	state_running = "running"
+	state_paused  = "paused"
+	state_stopped = "stopped"
+	state_dead    = "dead"
+)
+
+// containers stopped by the proxy itself, their die events are expected
+var expected_stops sync.Map
+
+func expect_stop(container_id string) {
+	expected_stops.Store(container_id, time.Now())
+}
+
+// update_proxy_state changes the state of the proxy entry which belongs
+// to the container
+func update_proxy_state(username string, container_id string, state string, reason string) {
+	result, ok := proxies.Load(username)
+	if !ok {
+		return
+	}
+	pe := result.(proxy_service)
+	if pe.container_id != container_id {
+		return
+	}
+	pe.state = state
+	pe.reason = reason
+	pe.ready = state == state_running
+	proxies.Store(username, pe)
+}
+
+func handle_event(msg events.Message) {
+	username := msg.Actor.Attributes[label_user]
+	container_id := msg.Actor.ID
+	if username == "" {
+		return
+	}
+	if Debug {
+		log.Printf("Docker event for '%s': %s (%v)", username, msg.Action, msg.Actor.Attributes)
+	}
+
+	switch {
+	case msg.Action == "start":
+		// the address may change after a restart
+		restart_upstream(username, container_id)
+	case msg.Action == "die":
+		if _, ok := expected_stops.LoadAndDelete(container_id); ok {
+			return
+		}
+		reason := fmt.Sprintf("exit code %s", msg.Actor.Attributes["exitCode"])
+		log.Printf("Container of '%s' died (%s)!", username, reason)
+		update_proxy_state(username, container_id, state_dead, reason)
+		breaker_failure(username, "container died, "+reason)
+	case msg.Action == "oom":
+		oom_reported.Store(container_id, true)
+		record_oom(username)
+		update_proxy_state(username, container_id, state_dead, "out of memory")
+	case msg.Action == "destroy":
+		if result, ok := proxies.Load(username); ok && result.(proxy_service).container_id == container_id {
+			log.Printf("Container of '%s' was removed!", username)
+			proxies.Delete(username)
+		}
+		expected_stops.Delete(container_id)
+		oom_reported.Delete(container_id)
+	case strings.HasPrefix(msg.Action, "health_status"):
+		status := strings.TrimSpace(strings.TrimPrefix(msg.Action, "health_status:"))
+		if status != "unhealthy" {
+			return
+		}
+		log.Printf("Container of '%s' is unhealthy -> removing!", username)
+		update_proxy_state(username, container_id, state_dead, "unhealthy")
+		breaker_failure(username, "container is unhealthy")
+		if err := RemoveContainer(username, container_id); err != nil {
+			log.Printf("Removing container for '%s' failed (%v)", username, err)
+		}
+	}
+}
+
+// invalidate_upstreams forces a verification of all upstreams, events
+// may be lost while the subscription was broken
+func invalidate_upstreams() {
+	proxies_lock.Lock()
+	defer proxies_lock.Unlock()
+	proxies.Range(func(key any, value any) bool {
+		pe := value.(proxy_service)
+		if pe.ready {
+			pe.verified = time.Time{}
+			proxies.Store(key, pe)
+		}
+		return true
+	})
+}
+
+// Service_events
+//
+// subscribes to the docker events of the user containers, the
+// subscription is renewed if the connection breaks and resumes with
+// the last seen event
+func Service_events() {
+	args := filters.NewArgs(
+		filters.Arg("type", "container"),
+		filters.Arg("label", fmt.Sprintf("%s=%s", label_instance, instance_id)),
+	)
+	for _, action := range []string{"start", "die", "oom", "destroy", "health_status"} {
+		args.Add("event", action)
+	}
+
+	var last int64 // time of the last event in unix nanoseconds
+	for {
+		options := types.EventsOptions{Filters: args}
+		if last > 0 {
+			options.Since = fmt.Sprintf("%d.%09d", last/1e9, last%1e9)
+			log.Printf("Watching docker events since %v ...", time.Unix(0, last))
+		} else {
+			log.Printf("Watching docker events ...")
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		msgs, errs := docker.Events(ctx, options)
+		if last > 0 {
+			invalidate_upstreams()
+		}
+
+	loop:
+		for {
+			select {
+			case msg := <-msgs:
+				if msg.TimeNano > last {
+					last = msg.TimeNano
+				}
+				handle_event(msg)
+			case err := <-errs:
+				log.Printf("Docker events failed (%v), reconnecting ...", err)
+				if last == 0 {
+					last = time.Now().UnixNano()
+				}
+				break loop
+			}
+		}
+		cancel()
+		time.Sleep(5 * time.Second)
+	}
+}
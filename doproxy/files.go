@@ -0,0 +1,243 @@
+package doproxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+// files related functions
+//
+// os/user reads only the passwd file of the proxy container if the
+// binary is built without cgo, the files provider reads a configurable
+// passwd/group file instead (e.g. the bind-mounted file of the host)
+
+var files_passwd string = "/etc/passwd"
+var files_group string = "/etc/group"
+
+// pattern components
+var pattern_public string = "/users/{user}/public_html"
+var pattern_check_exists bool = true
+var pattern_check_owner bool = false
+
+// allowed characters for usernames which are used inside of paths
+var re_username = regexp.MustCompile("^[a-zA-Z0-9_][a-zA-Z0-9._-]*$")
+
+func init_files(data map[interface{}]interface{}) {
+	files := config_section(data, "files")
+	files_passwd = config_string(files, "passwd", files_passwd)
+	files_group = config_string(files, "group", files_group)
+
+	pattern := config_section(data, "pattern")
+	pattern_public = config_string(pattern, "public", pattern_public)
+	pattern_check_exists = config_bool(pattern, "check_exists", pattern_check_exists)
+	pattern_check_owner = config_bool(pattern, "check_owner", pattern_check_owner)
+
+	if !strings.Contains(pattern_public, "{user}") {
+		log.Fatalf("Config: pattern '%s' does not contain {user}", pattern_public)
+	}
+}
+
+type passwd_entry struct {
+	name string
+	uid  string
+	gid  string
+	home string
+}
+
+// read_colon_file calls f for every line of a passwd/group like file
+func read_colon_file(filename string, f func([]string) bool) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !f(strings.Split(line, ":")) {
+			break
+		}
+	}
+	return scanner.Err()
+}
+
+func lookup_passwd_file(username string) (passwd_entry, error) {
+	var result passwd_entry
+	found := false
+
+	err := read_colon_file(files_passwd, func(fields []string) bool {
+		// name:password:uid:gid:gecos:home:shell
+		if len(fields) < 7 || fields[0] != username {
+			return true
+		}
+		result = passwd_entry{name: fields[0], uid: fields[2], gid: fields[3], home: fields[5]}
+		found = true
+		return false
+	})
+	if err != nil {
+		return result, err
+	}
+	if !found {
+		return result, errors.New("user not found")
+	}
+	return result, nil
+}
+
+// lookup_group_file returns the names of the primary group and all
+// groups which list the user as a member, and the ids of the
+// supplementary groups
+func lookup_group_file(username string, gid string) ([]string, []string, error) {
+	var groups []string
+	var gids []string
+
+	err := read_colon_file(files_group, func(fields []string) bool {
+		// name:password:gid:members
+		if len(fields) < 4 {
+			return true
+		}
+		if fields[2] == gid {
+			groups = append(groups, fields[0])
+		} else if contains_string(strings.Split(fields[3], ","), username) {
+			groups = append(groups, fields[0])
+			gids = append(gids, fields[2])
+		}
+		return true
+	})
+	return groups, gids, err
+}
+
+func GetFilesInfos(username string) (user_infos, error) {
+	infos := user_infos{attributes: make(map[string][]string)}
+
+	entry, err := lookup_passwd_file(username)
+	if err != nil {
+		return infos, err
+	}
+
+	infos.home = entry.home
+	infos.uid = entry.uid
+	infos.gid = entry.gid
+
+	if len(profiles) > 0 || docker_supplementary_groups {
+		groups, gids, err := lookup_group_file(username, entry.gid)
+		if err != nil {
+			log.Printf("Can't read the groups of '%s' from %s (%v)", username, files_group, err)
+		}
+		infos.groups = groups
+		infos.gids = gids
+	}
+
+	return infos, nil
+}
+
+// file_owner returns the uid and gid of a file
+func file_owner(filename string) (uint32, uint32, error) {
+	finfo, err := os.Stat(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	stat, ok := finfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, fmt.Errorf("can't read the owner of %s", filename)
+	}
+	return stat.Uid, stat.Gid, nil
+}
+
+// check_pattern_owner verifies that every path component starting with
+// the first component containing the username is owned by the same
+// non-root user
+func check_pattern_owner(username string, public string) error {
+	parts := strings.Split(pattern_public, "/")
+	base := ""
+	for _, part := range parts {
+		base = base + part + "/"
+		if strings.Contains(part, "{user}") {
+			break
+		}
+	}
+	base = filepath.Clean(strings.ReplaceAll(base, "{user}", username))
+	// the checks are done on the paths seen by the proxy
+	base, _ = translate_path(base)
+	public, _ = translate_path(public)
+
+	owner, _, err := file_owner(base)
+	if err != nil {
+		return err
+	}
+	if owner == 0 {
+		return fmt.Errorf("%s is owned by root", base)
+	}
+
+	rel, err := filepath.Rel(base, public)
+	if err != nil {
+		return err
+	}
+	dir := base
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if part == "." {
+			continue
+		}
+		dir = filepath.Join(dir, part)
+		uid, _, err := file_owner(dir)
+		if err != nil {
+			return err
+		}
+		if uid != owner {
+			return fmt.Errorf("%s is not owned by the owner of %s", dir, base)
+		}
+	}
+	return nil
+}
+
+// GetPatternInfos creates the public directory from a pattern like
+// /users/{user}/public_html, no account database is needed
+func GetPatternInfos(username string) (user_infos, error) {
+	infos := user_infos{attributes: make(map[string][]string)}
+
+	if !re_username.MatchString(username) {
+		return infos, errors.New("invalid username")
+	}
+
+	public := filepath.Clean(strings.ReplaceAll(pattern_public, "{user}", username))
+
+	if pattern_check_exists {
+		proxy_path, _ := translate_path(public)
+		finfo, err := os.Stat(proxy_path)
+		if err != nil {
+			return infos, errors.New("user not found")
+		}
+		if !finfo.IsDir() {
+			return infos, fmt.Errorf("%s is not a directory", public)
+		}
+	}
+
+	if pattern_check_owner {
+		if err := check_pattern_owner(username, public); err != nil {
+			log.Printf("Ownership check for '%s' failed (%v)", username, err)
+			return infos, errors.New("ownership check failed")
+		}
+	}
+
+	infos.public = public
+
+	// without an account database the owner of the public directory is
+	// the user of the container
+	proxy_path, _ := translate_path(public)
+	if uid, gid, err := file_owner(proxy_path); err == nil {
+		infos.uid = fmt.Sprintf("%d", uid)
+		infos.gid = fmt.Sprintf("%d", gid)
+	}
+
+	return infos, nil
+}
@@ -0,0 +1,135 @@
+package doproxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// idle tiers
+//
+// an idle container is paused after pause_after seconds, stopped after
+// stop_after seconds and removed after the culling timeout, a request
+// for a paused or stopped container unpauses or starts it again, which
+// is much faster than a new container, a tier with 0 seconds is skipped
+
+var cull_pause_after int = 0
+var cull_stop_after int = 0
+
+func init_idle(data map[interface{}]interface{}) {
+	section := config_section(data, "cull")
+	cull_pause_after = config_int(section, "pause_after", cull_pause_after)
+	cull_stop_after = config_int(section, "stop_after", cull_stop_after)
+
+	if cull_pause_after > 0 || cull_stop_after > 0 {
+		log.Printf("Idle tiers: pause after %ds, stop after %ds, remove after %ds",
+			cull_pause_after, cull_stop_after, Culling_timeout)
+	}
+}
+
+// idle_tiers pauses or stops an idle container
+func idle_tiers(username string, pe proxy_service, idle float64) {
+	switch {
+	case cull_stop_after > 0 && idle > float64(cull_stop_after) && pe.state != state_stopped:
+		if pe.activity.start_drain() {
+			log.Printf("Stopping idle container of '%s' ...", username)
+			go stop_idle_container(username, pe)
+		}
+	case cull_pause_after > 0 && idle > float64(cull_pause_after) && pe.state == state_running:
+		// the same barrier as the draining, a request either sees the
+		// pause or the pause sees the request
+		if !pe.activity.start_drain() {
+			return
+		}
+		defer pe.activity.stop_drain()
+		if pe.activity.active() > 0 {
+			return
+		}
+		if err := docker.ContainerPause(context.Background(), pe.container_id); err != nil {
+			log.Printf("Pausing container of '%s' failed (%v)", username, err)
+			return
+		}
+		log.Printf("Container of '%s' paused!", username)
+		set_proxy_state(username, pe, state_paused)
+	}
+}
+
+// set_proxy_state changes the state of the entry, if it is still the
+// same
+func set_proxy_state(username string, pe proxy_service, state string) {
+	proxies_lock.Lock()
+	defer proxies_lock.Unlock()
+	if result, ok := proxies.Load(username); ok && result.(proxy_service).activity == pe.activity {
+		current := result.(proxy_service)
+		current.state = state
+		proxies.Store(username, current)
+	}
+}
+
+// stop_idle_container drains and stops a container, the proxy entry is
+// kept for a fast start
+func stop_idle_container(username string, pe proxy_service) {
+	wait_for_drain(username, pe)
+
+	if pe.state == state_paused {
+		docker.ContainerUnpause(context.Background(), pe.container_id)
+	}
+	err := stop_container(username, pe.container_id, false)
+	if err != nil {
+		log.Printf("Stopping container for '%s' failed (%v)", username, err.Error())
+		delete_proxy(username, pe)
+		return
+	}
+
+	set_proxy_state(username, pe, state_stopped)
+	pe.activity.stop_drain()
+}
+
+// wake_container unpauses or starts the container of a proxy entry,
+// parallel requests wait for the first one, which wakes the container
+func wake_container(username string, pe proxy_service) (proxy_service, error) {
+	if pe.state == state_running {
+		return pe, nil
+	}
+	pe.activity.wake.Lock()
+	defer pe.activity.wake.Unlock()
+
+	// another request may have woken the container in the meantime
+	result, ok := proxies.Load(username)
+	if !ok || result.(proxy_service).activity != pe.activity {
+		return pe, errors.New("proxy entry was removed")
+	}
+	pe = result.(proxy_service)
+
+	switch pe.state {
+	case state_paused:
+		log.Printf("Unpausing container of '%s' ...", username)
+		if err := docker.ContainerUnpause(context.Background(), pe.container_id); err != nil {
+			return pe, err
+		}
+	case state_stopped:
+		if err := acquire_capacity(username, pe.memory, true); err != nil {
+			return pe, err
+		}
+		defer release_capacity(username)
+		log.Printf("Starting stopped container of '%s' ...", username)
+		if err := docker.ContainerStart(context.Background(), pe.container_id, types.ContainerStartOptions{}); err != nil {
+			return pe, err
+		}
+		if _, err := wait_for_running(pe.container_id); err != nil {
+			return pe, err
+		}
+		// the address may have changed
+		pe.verified = time.Time{}
+	case state_running:
+		return pe, nil
+	default:
+		return pe, errors.New("unknown container state " + pe.state)
+	}
+	pe.state = state_running
+	set_proxy_state(username, pe, state_running)
+	return pe, nil
+}
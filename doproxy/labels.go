@@ -0,0 +1,140 @@
+package doproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/errdefs"
+)
+
+// container ownership
+//
+// every spawned container is labelled with the proxy instance, the
+// username, the spawn time and a hash of the container configuration,
+// all lookups use these labels instead of the container names
+
+const (
+	label_instance    = "hrp.instance"
+	label_user        = "hrp.user"
+	label_spawned     = "hrp.spawned"
+	label_config_hash = "hrp.config_hash"
+	label_profile     = "hrp.profile"
+	label_pool        = "hrp.pool"
+)
+
+var instance_id string = "default"
+var name_template string = "userwebsite_{user}"
+
+func init_labels(data map[interface{}]interface{}) {
+	section := config_section(data, "docker")
+	instance_id = config_string(section, "instance", instance_id)
+	name_template = config_string(section, "name_template", name_template)
+
+	if !strings.Contains(name_template, "{user}") {
+		log.Fatalf("Config: name_template '%s' does not contain {user}", name_template)
+	}
+	// the containers of several instances must not share their names
+	if instance_id != "default" && !strings.Contains(name_template, "{instance}") {
+		log.Fatalf("Config: name_template '%s' of instance '%s' does not contain {instance}", name_template, instance_id)
+	}
+	log.Printf("Proxy instance: %s (container names: %s)", instance_id, name_template)
+}
+
+// container_name creates the name of a user container
+func container_name(username string) string {
+	name := strings.ReplaceAll(name_template, "{instance}", instance_id)
+	return strings.ReplaceAll(name, "{user}", username)
+}
+
+// config_hash identifies the settings of a container, a changed hash
+// means the container has to be recreated
+func config_hash(config *container.Config, hostConfig *container.HostConfig) string {
+	content, err := json.Marshal([]interface{}{config, hostConfig})
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(content))[:16]
+}
+
+// container_labels returns the ownership labels of a new container
+func container_labels(username string, profile string, hash string) map[string]string {
+	return map[string]string{
+		label_instance:    instance_id,
+		label_user:        username,
+		label_spawned:     time.Now().UTC().Format(time.RFC3339),
+		label_config_hash: hash,
+		label_profile:     profile,
+	}
+}
+
+// instance_filters selects all containers of this proxy instance, an
+// empty username selects the containers of all users
+func instance_filters(username string) filters.Args {
+	args := filters.NewArgs(filters.Arg("label", fmt.Sprintf("%s=%s", label_instance, instance_id)))
+	if username != "" {
+		args.Add("label", fmt.Sprintf("%s=%s", label_user, username))
+	}
+	return args
+}
+
+// ListUserContainers returns the containers of a user (or of all users)
+// owned by this proxy instance
+func ListUserContainers(username string, all bool) ([]types.Container, error) {
+	return docker.ContainerList(context.Background(), types.ContainerListOptions{
+		All:     all,
+		Filters: instance_filters(username),
+	})
+}
+
+// name_conflict explains a failed creation, if a container with the
+// same name is not owned by this proxy instance (e.g. an unlabelled
+// container of an older release)
+func name_conflict(username string, name string, err error) error {
+	if !errdefs.IsConflict(err) {
+		return err
+	}
+	data, ierr := docker.ContainerInspect(context.Background(), name)
+	if ierr != nil || data.Config == nil || data.Config.Labels[label_instance] == instance_id {
+		return err
+	}
+	owner := data.Config.Labels[label_instance]
+	if owner == "" {
+		owner = "an older release without labels"
+	}
+	log.Printf("MIGRATION: container %s of '%s' was created by %s, remove it with 'docker rm -f %s'",
+		name, username, owner, name)
+	return fmt.Errorf("container name %s is used by a foreign container", name)
+}
+
+// report_foreign_containers logs the containers with the name of a user
+// container, which are not owned by this instance, they block the
+// spawns of their users until they are removed
+func report_foreign_containers() {
+	prefix, _, _ := strings.Cut(strings.ReplaceAll(name_template, "{instance}", instance_id), "{user}")
+	if prefix == "" {
+		return
+	}
+	containers, err := docker.ContainerList(context.Background(), types.ContainerListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("name", "^/"+prefix)),
+	})
+	if err != nil {
+		log.Printf("Can't read the list of containers (%v)", err)
+		return
+	}
+	for _, c := range containers {
+		if c.Labels[label_instance] == instance_id || len(c.Names) == 0 {
+			continue
+		}
+		log.Printf("MIGRATION: container %s is not owned by instance '%s', remove it with 'docker rm -f %s'",
+			c.Names[0], instance_id, strings.TrimPrefix(c.Names[0], "/"))
+	}
+}
@@ -0,0 +1,45 @@
+package doproxy
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// metrics
+//
+// counters in the prometheus text format, available as admin request
+
+var metric_evictions int64
+var metric_queued int64
+var metric_busy int64
+var metric_pressure_evictions int64
+
+func count_metric(counter *int64) {
+	atomic.AddInt64(counter, 1)
+}
+
+func handle_metrics(w http.ResponseWriter) {
+	count, memory := capacity_usage("")
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "hrp_containers_running %d\n", count)
+	fmt.Fprintf(w, "hrp_containers_memory_bytes %d\n", memory)
+	fmt.Fprintf(w, "hrp_evictions_total %d\n", atomic.LoadInt64(&metric_evictions))
+	fmt.Fprintf(w, "hrp_spawns_queued_total %d\n", atomic.LoadInt64(&metric_queued))
+	fmt.Fprintf(w, "hrp_spawns_busy_total %d\n", atomic.LoadInt64(&metric_busy))
+	fmt.Fprintf(w, "hrp_pressure_evictions_total %d\n", atomic.LoadInt64(&metric_pressure_evictions))
+	fmt.Fprintf(w, "hrp_prewarm_starts_total %d\n", atomic.LoadInt64(&metric_prewarm_starts))
+	fmt.Fprintf(w, "hrp_prewarm_hits_total %d\n", atomic.LoadInt64(&metric_prewarm_hits))
+	fmt.Fprintf(w, "hrp_prewarm_wasted_total %d\n", atomic.LoadInt64(&metric_prewarm_wasted))
+	fmt.Fprintf(w, "hrp_prewarm_hit_rate %.3f\n", prewarm_hit_rate())
+	fmt.Fprintf(w, "hrp_pool_containers %d\n", pool_length())
+	fmt.Fprintf(w, "hrp_pool_target %d\n", atomic.LoadInt64(&pool_target))
+	fmt.Fprintf(w, "hrp_pool_created_total %d\n", atomic.LoadInt64(&metric_pool_created))
+	fmt.Fprintf(w, "hrp_pool_hits_total %d\n", atomic.LoadInt64(&metric_pool_hits))
+	fmt.Fprintf(w, "hrp_pool_removed_total %d\n", atomic.LoadInt64(&metric_pool_removed))
+	oom_kills.Range(func(key any, value any) bool {
+		fmt.Fprintf(w, "hrp_oom_kills_total{user=%q} %d\n", key, value)
+		return true
+	})
+}
@@ -0,0 +1,330 @@
+package doproxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/go-units"
+)
+
+// mount specifications
+//
+// additional directories are given either in the short form
+//
+//	/vol/data                 bind mount at the same path, default mode
+//	/vol/data::ro             bind mount at the same path, read-only
+//	/vol/data::/data::ro      bind mount at /data, read-only
+//
+// or in the long form known from docker run --mount
+//
+//	type=bind,source=/vol/data,target=/data,ro,propagation=rslave
+//	type=volume,source=cache,target=/cache,nocopy
+//	type=tmpfs,target=/scratch,size=64m,mode=1777
+//
+// for bind mounts the source is a directory service path, which is
+// translated into the proxy and the host path, mounts without ro or rw
+// use the configured default mode, volumes must be listed in
+// allowed_volumes
+
+// mount restrictions
+var mounts_allowed_roots []string
+var mounts_forbidden = []string{"/etc", "/proc", "/sys", "/dev", "/boot", "/root",
+	"/var/run/docker.sock", "/run/docker.sock"}
+var mounts_default_ro bool = true
+var mounts_allowed_volumes []string
+
+func init_mounts(data map[interface{}]interface{}) {
+	mounts := config_section(data, "mounts")
+	mounts_allowed_roots = config_strings(mounts, "allowed_roots")
+	mounts_forbidden = append(mounts_forbidden, config_strings(mounts, "forbidden")...)
+	mounts_allowed_volumes = config_strings(mounts, "allowed_volumes")
+	switch mode := config_string(mounts, "default_mode", "ro"); mode {
+	case "ro":
+		mounts_default_ro = true
+	case "rw":
+		mounts_default_ro = false
+	default:
+		log.Fatalf("Config: unknown mount mode '%s', only ro|rw are allowed", mode)
+	}
+
+	for _, root := range mounts_allowed_roots {
+		if !filepath.IsAbs(root) || filepath.Clean(root) == "/" {
+			log.Fatalf("Config: allowed mount root '%s' must be an absolute path below /", root)
+		}
+	}
+	if len(mounts_allowed_roots) == 0 {
+		log.Printf("No allowed mount roots configured, additional directories are not restricted!")
+	} else {
+		log.Printf("Allowed mount roots: %v", mounts_allowed_roots)
+	}
+}
+
+// resolve_proxy_path returns the path without any symlinks, a not
+// resolvable path is returned unchanged
+func resolve_proxy_path(path string) string {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	return filepath.Clean(path)
+}
+
+// check_forbidden_path verifies that a proxy path (with symlinks
+// resolved) is neither inside of a forbidden path nor contains one,
+// the root directory is always forbidden
+func check_forbidden_path(proxy_path string) error {
+	if proxy_path == "/" || proxy_to_host_path(proxy_path) == "/" {
+		return errors.New("/ is a forbidden path")
+	}
+	for _, forbidden := range mounts_forbidden {
+		forbidden_path, _ := translate_path(forbidden)
+		for _, f := range []string{resolve_proxy_path(forbidden_path), filepath.Clean(forbidden)} {
+			if has_path_prefix(proxy_path, f) || has_path_prefix(f, proxy_path) {
+				return fmt.Errorf("%s is a forbidden path", forbidden)
+			}
+		}
+	}
+	return nil
+}
+
+// check_mount_source verifies that a proxy path (with symlinks resolved)
+// lies below an allowed root and doesn't touch a forbidden path
+func check_mount_source(proxy_path string) error {
+	if err := check_forbidden_path(proxy_path); err != nil {
+		return err
+	}
+
+	if len(mounts_allowed_roots) == 0 {
+		return nil
+	}
+	for _, root := range mounts_allowed_roots {
+		root_path, _ := translate_path(root)
+		if has_path_prefix(proxy_path, resolve_proxy_path(root_path)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("path is outside of the allowed roots %v", mounts_allowed_roots)
+}
+
+// check_public_directory resolves the public directory and returns its
+// host path, the directory must stay inside of the home directory or
+// below an allowed root
+func check_public_directory(home string, public string) (string, error) {
+	proxy_path, _ := translate_path(public)
+	finfo, err := os.Stat(proxy_path)
+	if err != nil {
+		return "", err
+	}
+	if !finfo.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", public)
+	}
+	resolved := resolve_proxy_path(proxy_path)
+	if err := check_forbidden_path(resolved); err != nil {
+		return "", err
+	}
+
+	home_path, _ := translate_path(home)
+	if !has_path_prefix(resolved, resolve_proxy_path(home_path)) {
+		if len(mounts_allowed_roots) == 0 {
+			return "", fmt.Errorf("%s points outside of the home directory", public)
+		}
+		if err := check_mount_source(resolved); err != nil {
+			return "", err
+		}
+	}
+	// mount the resolved path, a symlink can't be swapped later
+	return proxy_to_host_path(resolved), nil
+}
+
+// audit_mount logs every rejected mount
+func audit_mount(username string, spec string, err error) {
+	log.Printf("AUDIT: rejected mount for '%s': %s (%v)", username, spec, err)
+}
+
+// ParseMountSpec converts a mount specification into a docker mount
+func ParseMountSpec(spec string) (mount.Mount, error) {
+	if strings.Contains(spec, "=") {
+		return parse_long_mount_spec(spec)
+	}
+	return parse_short_mount_spec(spec)
+}
+
+func parse_short_mount_spec(spec string) (mount.Mount, error) {
+	s := strings.Split(spec, "::")
+	m := mount.Mount{Type: mount.TypeBind, Source: s[0], Target: s[0], ReadOnly: mounts_default_ro}
+
+	if len(s) > 3 {
+		return m, fmt.Errorf("too many '::' separated fields")
+	}
+	for _, field := range s[1:] {
+		switch {
+		case field == "ro":
+			m.ReadOnly = true
+		case field == "rw":
+			m.ReadOnly = false
+		case strings.HasPrefix(field, "/") && m.Target == m.Source:
+			m.Target = field
+		default:
+			return m, fmt.Errorf("unknown field '%s'", field)
+		}
+	}
+	return m, nil
+}
+
+func parse_long_mount_spec(spec string) (mount.Mount, error) {
+	m := mount.Mount{Type: mount.TypeBind, ReadOnly: mounts_default_ro}
+
+	for _, field := range strings.Split(spec, ",") {
+		key, value, has_value := strings.Cut(strings.TrimSpace(field), "=")
+		switch key {
+		case "type":
+			switch mount.Type(value) {
+			case mount.TypeBind, mount.TypeVolume, mount.TypeTmpfs:
+				m.Type = mount.Type(value)
+			default:
+				return m, fmt.Errorf("unknown type '%s'", value)
+			}
+		case "source", "src":
+			m.Source = value
+		case "target", "dst", "destination":
+			m.Target = value
+		case "ro", "readonly":
+			ro := true
+			if has_value {
+				b, err := strconv.ParseBool(value)
+				if err != nil {
+					return m, fmt.Errorf("invalid value '%s' for %s", value, key)
+				}
+				ro = b
+			}
+			m.ReadOnly = ro
+		case "rw":
+			m.ReadOnly = false
+		case "propagation", "bind-propagation":
+			switch mount.Propagation(value) {
+			case mount.PropagationPrivate, mount.PropagationRPrivate,
+				mount.PropagationShared, mount.PropagationRShared,
+				mount.PropagationSlave, mount.PropagationRSlave:
+				m.BindOptions = &mount.BindOptions{Propagation: mount.Propagation(value)}
+			default:
+				return m, fmt.Errorf("unknown propagation '%s'", value)
+			}
+		case "nocopy", "volume-nocopy":
+			m.VolumeOptions = &mount.VolumeOptions{NoCopy: true}
+		case "size", "tmpfs-size":
+			size, err := units.RAMInBytes(value)
+			if err != nil {
+				return m, fmt.Errorf("invalid size '%s'", value)
+			}
+			if m.TmpfsOptions == nil {
+				m.TmpfsOptions = &mount.TmpfsOptions{}
+			}
+			m.TmpfsOptions.SizeBytes = size
+		case "mode", "tmpfs-mode":
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil {
+				return m, fmt.Errorf("invalid mode '%s'", value)
+			}
+			if m.TmpfsOptions == nil {
+				m.TmpfsOptions = &mount.TmpfsOptions{}
+			}
+			m.TmpfsOptions.Mode = os.FileMode(mode)
+		default:
+			return m, fmt.Errorf("unknown option '%s'", key)
+		}
+	}
+
+	// the target of a bind mount defaults to its source
+	if m.Type == mount.TypeBind && m.Target == "" {
+		m.Target = m.Source
+	}
+
+	// check the combinations of the options
+	switch m.Type {
+	case mount.TypeBind:
+		if m.VolumeOptions != nil || m.TmpfsOptions != nil {
+			return m, fmt.Errorf("volume/tmpfs options are not allowed for bind mounts")
+		}
+	case mount.TypeVolume:
+		if m.BindOptions != nil || m.TmpfsOptions != nil {
+			return m, fmt.Errorf("bind/tmpfs options are not allowed for volumes")
+		}
+	case mount.TypeTmpfs:
+		if m.Source != "" {
+			return m, fmt.Errorf("tmpfs mounts have no source")
+		}
+		if m.BindOptions != nil || m.VolumeOptions != nil {
+			return m, fmt.Errorf("bind/volume options are not allowed for tmpfs mounts")
+		}
+	}
+	return m, nil
+}
+
+// check_mount validates a parsed mount and translates the source path
+// of a bind mount into the host path, symlinks are resolved before the
+// source is checked against the allowed roots
+func check_mount(m mount.Mount) (mount.Mount, error) {
+	if m.Target == "" || !filepath.IsAbs(m.Target) {
+		return m, fmt.Errorf("target '%s' must be an absolute path", m.Target)
+	}
+	m.Target = filepath.Clean(m.Target)
+
+	switch m.Type {
+	case mount.TypeBind:
+		if !filepath.IsAbs(m.Source) {
+			return m, fmt.Errorf("source '%s' must be an absolute path", m.Source)
+		}
+		proxy_path, _ := translate_path(m.Source)
+		if _, err := os.Stat(proxy_path); err != nil {
+			return m, fmt.Errorf("%s not found", m.Source)
+		}
+		resolved := resolve_proxy_path(proxy_path)
+		if err := check_mount_source(resolved); err != nil {
+			return m, err
+		}
+		// mount the resolved path, a symlink can't be swapped later
+		m.Source = proxy_to_host_path(resolved)
+	case mount.TypeVolume:
+		if m.Source == "" || strings.Contains(m.Source, "/") {
+			return m, fmt.Errorf("volume needs a name as source")
+		}
+		if !contains_string(mounts_allowed_volumes, m.Source) {
+			return m, fmt.Errorf("volume '%s' is not an allowed volume", m.Source)
+		}
+	}
+	return m, nil
+}
+
+// CheckAdditionalDirectories adds all valid mount specifications to the
+// mount array, rejected entries are collected in a report for the user
+func CheckAdditionalDirectories(username string, directories []string, mounts []mount.Mount) []mount.Mount {
+	var report []string
+
+	for _, dir := range directories {
+		if Debug {
+			log.Printf("Mount spec for '%s': %s", username, dir)
+		}
+		m, err := ParseMountSpec(dir)
+		if err == nil {
+			m, err = check_mount(m)
+		}
+		if err != nil {
+			audit_mount(username, dir, err)
+			report = append(report, fmt.Sprintf("'%s': %v", dir, err))
+			continue
+		}
+		mounts = append(mounts, m)
+	}
+
+	if len(report) > 0 {
+		log.Printf("Mount report for '%s': %d of %d entries rejected:\n  - %s",
+			username, len(report), len(directories), strings.Join(report, "\n  - "))
+	}
+
+	return mounts
+}
@@ -0,0 +1,214 @@
+package doproxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types/mount"
+)
+
+func TestParseMountSpec(t *testing.T) {
+	mounts_default_ro = true
+
+	tests := []struct {
+		spec    string
+		want    mount.Mount
+		invalid bool
+	}{
+		{spec: "/vol/data", want: mount.Mount{Type: mount.TypeBind, Source: "/vol/data", Target: "/vol/data", ReadOnly: true}},
+		{spec: "/vol/data::rw", want: mount.Mount{Type: mount.TypeBind, Source: "/vol/data", Target: "/vol/data"}},
+		{spec: "/vol/data::/data::ro", want: mount.Mount{Type: mount.TypeBind, Source: "/vol/data", Target: "/data", ReadOnly: true}},
+		{spec: "/vol/data::/data::rw", want: mount.Mount{Type: mount.TypeBind, Source: "/vol/data", Target: "/data"}},
+		{spec: "/vol/data::/a::/b", invalid: true},
+		{spec: "/vol/data::data", invalid: true},
+		{spec: "/vol/data::ro::rw::ro", invalid: true},
+		{
+			spec: "type=bind,source=/vol/data,target=/data,rw,propagation=rslave",
+			want: mount.Mount{Type: mount.TypeBind, Source: "/vol/data", Target: "/data",
+				BindOptions: &mount.BindOptions{Propagation: mount.PropagationRSlave}},
+		},
+		{spec: "type=bind,src=/vol/data,readonly=false", want: mount.Mount{Type: mount.TypeBind, Source: "/vol/data", Target: "/vol/data"}},
+		{
+			spec: "type=volume,source=cache,target=/cache,nocopy",
+			want: mount.Mount{Type: mount.TypeVolume, Source: "cache", Target: "/cache", ReadOnly: true,
+				VolumeOptions: &mount.VolumeOptions{NoCopy: true}},
+		},
+		{
+			spec: "type=tmpfs,target=/scratch,size=64m,mode=1777,rw",
+			want: mount.Mount{Type: mount.TypeTmpfs, Target: "/scratch",
+				TmpfsOptions: &mount.TmpfsOptions{SizeBytes: 64 * 1024 * 1024, Mode: 01777}},
+		},
+		{spec: "type=tmpfs,source=/vol/data,target=/scratch", invalid: true},
+		{spec: "type=bind,source=/vol/data,size=1m", invalid: true},
+		{spec: "type=volume,source=cache,target=/cache,propagation=shared", invalid: true},
+		{spec: "type=npipe,source=/vol/data", invalid: true},
+		{spec: "type=bind,source=/vol/data,readonly=maybe", invalid: true},
+		{spec: "type=bind,source=/vol/data,propagation=everywhere", invalid: true},
+		{spec: "type=bind,source=/vol/data,unknown=1", invalid: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseMountSpec(tt.spec)
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("ParseMountSpec(%q) = %+v, want an error", tt.spec, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseMountSpec(%q) failed: %v", tt.spec, err)
+			continue
+		}
+		if got.Type != tt.want.Type || got.Source != tt.want.Source || got.Target != tt.want.Target ||
+			got.ReadOnly != tt.want.ReadOnly {
+			t.Errorf("ParseMountSpec(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+		if (got.BindOptions == nil) != (tt.want.BindOptions == nil) ||
+			(got.BindOptions != nil && *got.BindOptions != *tt.want.BindOptions) {
+			t.Errorf("ParseMountSpec(%q) bind options = %+v, want %+v", tt.spec, got.BindOptions, tt.want.BindOptions)
+		}
+		if (got.VolumeOptions == nil) != (tt.want.VolumeOptions == nil) ||
+			(got.VolumeOptions != nil && got.VolumeOptions.NoCopy != tt.want.VolumeOptions.NoCopy) {
+			t.Errorf("ParseMountSpec(%q) volume options = %+v, want %+v", tt.spec, got.VolumeOptions, tt.want.VolumeOptions)
+		}
+		if (got.TmpfsOptions == nil) != (tt.want.TmpfsOptions == nil) ||
+			(got.TmpfsOptions != nil && *got.TmpfsOptions != *tt.want.TmpfsOptions) {
+			t.Errorf("ParseMountSpec(%q) tmpfs options = %+v, want %+v", tt.spec, got.TmpfsOptions, tt.want.TmpfsOptions)
+		}
+	}
+}
+
+// with_mount_config sets the mount restrictions for a test
+func with_mount_config(t *testing.T, roots []string, forbidden []string, volumes []string) {
+	old_roots, old_forbidden, old_volumes, old_mappings := mounts_allowed_roots, mounts_forbidden, mounts_allowed_volumes, path_mappings
+	t.Cleanup(func() {
+		mounts_allowed_roots, mounts_forbidden, mounts_allowed_volumes, path_mappings = old_roots, old_forbidden, old_volumes, old_mappings
+	})
+	mounts_allowed_roots = roots
+	mounts_forbidden = append(append([]string{}, old_forbidden...), forbidden...)
+	mounts_allowed_volumes = volumes
+	path_mappings = nil
+}
+
+func TestCheckMountSource(t *testing.T) {
+	tests := []struct {
+		path    string
+		roots   []string
+		allowed bool
+	}{
+		{path: "/", allowed: false},
+		{path: "/var", allowed: false},
+		{path: "/var/run", allowed: false},
+		{path: "/run", allowed: false},
+		{path: "/etc", allowed: false},
+		{path: "/etc/ssl", allowed: false},
+		{path: "/root/.ssh", allowed: false},
+		{path: "/vol", allowed: false}, // contains /vol/secret
+		{path: "/vol/secret/keys", allowed: false},
+		{path: "/vol/data", allowed: true},
+		{path: "/home/user/data", allowed: true},
+		{path: "/etcetera", allowed: true},
+		{path: "/vol/data", roots: []string{"/vol/data"}, allowed: true},
+		{path: "/vol/data/sub", roots: []string{"/vol/data"}, allowed: true},
+		{path: "/vol/database", roots: []string{"/vol/data"}, allowed: false},
+		{path: "/home/user/data", roots: []string{"/vol/data"}, allowed: false},
+	}
+
+	for _, tt := range tests {
+		with_mount_config(t, tt.roots, []string{"/vol/secret"}, nil)
+		err := check_mount_source(tt.path)
+		if tt.allowed && err != nil {
+			t.Errorf("check_mount_source(%q) with roots %v failed: %v", tt.path, tt.roots, err)
+		}
+		if !tt.allowed && err == nil {
+			t.Errorf("check_mount_source(%q) with roots %v was allowed", tt.path, tt.roots)
+		}
+	}
+}
+
+func TestCheckMount(t *testing.T) {
+	dir := t.TempDir()
+	data := filepath.Join(dir, "data")
+	if err := os.Mkdir(data, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// a symlink inside of the allowed root pointing to a forbidden path
+	if err := os.Symlink("/etc", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		m       mount.Mount
+		allowed bool
+	}{
+		{m: mount.Mount{Type: mount.TypeBind, Source: data, Target: "/data"}, allowed: true},
+		{m: mount.Mount{Type: mount.TypeBind, Source: data, Target: "data"}, allowed: false},
+		{m: mount.Mount{Type: mount.TypeBind, Source: "data", Target: "/data"}, allowed: false},
+		{m: mount.Mount{Type: mount.TypeBind, Source: filepath.Join(dir, "missing"), Target: "/data"}, allowed: false},
+		{m: mount.Mount{Type: mount.TypeBind, Source: filepath.Join(dir, "link"), Target: "/data"}, allowed: false},
+		{m: mount.Mount{Type: mount.TypeVolume, Source: "cache", Target: "/cache"}, allowed: true},
+		{m: mount.Mount{Type: mount.TypeVolume, Source: "postgres_data", Target: "/db"}, allowed: false},
+		{m: mount.Mount{Type: mount.TypeVolume, Source: "/var/lib", Target: "/db"}, allowed: false},
+		{m: mount.Mount{Type: mount.TypeTmpfs, Target: "/scratch"}, allowed: true},
+	}
+
+	for _, tt := range tests {
+		with_mount_config(t, []string{dir}, nil, []string{"cache"})
+		_, err := check_mount(tt.m)
+		if tt.allowed && err != nil {
+			t.Errorf("check_mount(%+v) failed: %v", tt.m, err)
+		}
+		if !tt.allowed && err == nil {
+			t.Errorf("check_mount(%+v) was allowed", tt.m)
+		}
+	}
+}
+
+func TestCheckPublicDirectory(t *testing.T) {
+	dir := t.TempDir()
+	home := filepath.Join(dir, "home", "user")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{filepath.Join(home, "public_html"), filepath.Join(home, "real"), outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(home, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("real", filepath.Join(home, "inside")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/run", filepath.Join(home, "socket")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		public string
+		roots  []string
+		want   string
+	}{
+		{public: filepath.Join(home, "public_html"), want: filepath.Join(home, "public_html")},
+		{public: filepath.Join(home, "inside"), want: filepath.Join(home, "real")},
+		{public: filepath.Join(home, "escape"), want: ""},
+		{public: filepath.Join(home, "escape"), roots: []string{outside}, want: outside},
+		{public: filepath.Join(home, "socket"), roots: []string{"/run"}, want: ""},
+		{public: filepath.Join(home, "missing"), want: ""},
+	}
+
+	for _, tt := range tests {
+		with_mount_config(t, tt.roots, nil, nil)
+		got, err := check_public_directory(home, tt.public)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("check_public_directory(%q) = %q, want an error", tt.public, got)
+			}
+			continue
+		}
+		want, _ := filepath.EvalSymlinks(tt.want)
+		if err != nil || got != want {
+			t.Errorf("check_public_directory(%q) = %q, %v, want %q", tt.public, got, err, want)
+		}
+	}
+}
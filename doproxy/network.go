@@ -0,0 +1,202 @@
+package doproxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+)
+
+// network isolation
+//
+// shared:   all user containers join docker.network (default)
+// internal: all user containers join one internal network without
+//           internet access, the proxy joins this network too
+// per_user: every user container gets its own internal network, the
+//           proxy joins every network, containers can't reach each other
+//
+// the egress networks contain the allowed destinations of containers
+// with internal isolation, they are joined in addition (e.g. a network
+// with a database or a mail relay), docker can't filter destinations,
+// so the egress networks are refused with per_user isolation, where
+// they would connect the user containers with each other
+
+const (
+	isolation_shared   = "shared"
+	isolation_internal = "internal"
+	isolation_per_user = "per_user"
+)
+
+var network_isolation string = isolation_shared
+var network_internal string = "hrp_internal"
+var network_prefix string = "hrp_user_"
+var network_egress []string
+
+// id or name of the proxy container, empty if the proxy is running
+// on the host
+var proxy_container string = ""
+
+func init_network(data map[interface{}]interface{}) {
+	section := config_section(data, "docker")
+	network_isolation = config_string(section, "isolation", network_isolation)
+	network_internal = config_string(section, "internal_network", network_internal)
+	network_prefix = config_string(section, "network_prefix", network_prefix)
+	network_egress = config_strings(section, "egress_networks")
+	proxy_container = config_string(section, "proxy_container", "")
+
+	switch network_isolation {
+	case isolation_shared, isolation_internal, isolation_per_user:
+	default:
+		log.Fatalf("Config: unknown isolation '%s', only shared|internal|per_user are allowed", network_isolation)
+	}
+	if network_isolation == isolation_per_user && len(network_egress) > 0 {
+		log.Fatalf("Config: egress_networks can't be used with per_user isolation, the containers would reach each other")
+	}
+	log.Printf("Network isolation: %s (egress networks: %v)", network_isolation, network_egress)
+}
+
+// detect_proxy_container uses the hostname, which is the container id
+// inside of a container
+func detect_proxy_container() {
+	if proxy_container != "" || network_isolation == isolation_shared {
+		return
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return
+	}
+	if _, err := docker.ContainerInspect(context.Background(), hostname); err == nil {
+		proxy_container = hostname
+		log.Printf("Proxy is running in container %s", proxy_container)
+	} else {
+		log.Printf("Proxy is not running in a container, isolated networks are reached from the host")
+	}
+}
+
+// user_network returns the network used for the container of a user
+func user_network(username string) string {
+	switch network_isolation {
+	case isolation_internal:
+		return network_internal
+	case isolation_per_user:
+		return network_prefix + username
+	}
+	return docker_network
+}
+
+// container_ip extracts the IP address depending on the network settings
+func container_ip(username string, data types.ContainerJSON) string {
+	if data.NetworkSettings == nil {
+		return ""
+	}
+	network_name := user_network(username)
+	if network_name == "" {
+		return data.NetworkSettings.IPAddress
+	}
+	if endpoint, ok := data.NetworkSettings.Networks[network_name]; ok && endpoint != nil {
+		return endpoint.IPAddress
+	}
+	return ""
+}
+
+// CreateIsolatedNetwork creates an internal network (if missing) and
+// connects the proxy container to it
+func CreateIsolatedNetwork(network_name string) error {
+	networks, err := docker.NetworkList(context.Background(), types.NetworkListOptions{})
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, nw := range networks {
+		if nw.Name == network_name {
+			if !nw.Internal {
+				log.Printf("WARNING: network '%s' is not an internal network!", network_name)
+			}
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		options := types.NetworkCreate{
+			CheckDuplicate: true,
+			Driver:         "bridge",
+			Internal:       true,
+			Labels:         map[string]string{label_instance: instance_id},
+		}
+		log.Printf("Create internal network: %s", network_name)
+		if _, err := docker.NetworkCreate(context.Background(), network_name, options); err != nil {
+			return err
+		}
+	}
+
+	if proxy_container != "" {
+		err = docker.NetworkConnect(context.Background(), network_name, proxy_container, &network.EndpointSettings{})
+		if err != nil && !strings.Contains(err.Error(), "already exists") {
+			return fmt.Errorf("can't connect the proxy to network %s (%v)", network_name, err)
+		}
+	}
+	return nil
+}
+
+// setup_networks creates the networks at startup
+func setup_networks() error {
+	detect_proxy_container()
+
+	if err := CreateNetwork(docker_network); err != nil {
+		return err
+	}
+	if network_isolation == isolation_internal {
+		return CreateIsolatedNetwork(network_internal)
+	}
+	return nil
+}
+
+// prepare_user_network creates the per-user network before a spawn,
+// docker has only about 30 networks with its default address pools
+func prepare_user_network(username string) error {
+	if network_isolation != isolation_per_user {
+		return nil
+	}
+	err := CreateIsolatedNetwork(user_network(username))
+	if err != nil && strings.Contains(err.Error(), "non-overlapping") {
+		return fmt.Errorf("%v, the address pools of docker are exhausted, increase default-address-pools in daemon.json", err)
+	}
+	return err
+}
+
+// connect_egress_networks connects a created container to the allowed
+// egress networks
+func connect_egress_networks(username string, container_id string) {
+	for _, egress := range network_egress {
+		err := docker.NetworkConnect(context.Background(), egress, container_id, &network.EndpointSettings{})
+		if err != nil {
+			log.Printf("Can't connect container of '%s' to egress network %s (%v)", username, egress, err)
+		}
+	}
+}
+
+// remove_user_network removes the per-user network after the container
+// was removed
+func remove_user_network(username string) {
+	if network_isolation != isolation_per_user {
+		return
+	}
+	network_name := user_network(username)
+	if proxy_container != "" {
+		err := docker.NetworkDisconnect(context.Background(), network_name, proxy_container, true)
+		if err != nil && Debug {
+			log.Printf("Can't disconnect the proxy from network %s (%v)", network_name, err)
+		}
+	}
+	if err := docker.NetworkRemove(context.Background(), network_name); err != nil {
+		log.Printf("Can't remove network %s (%v)", network_name, err)
+	} else {
+		log.Printf("Network %s removed!", network_name)
+	}
+}
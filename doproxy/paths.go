@@ -0,0 +1,178 @@
+package doproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// path translation
+//
+// a directory has up to three different names: the path reported by
+// the directory service (LDAP, passwd), the path the proxy can access
+// (e.g. inside of its container) and the path on the docker host which
+// is used as the source of the bind mounts
+
+type path_mapping struct {
+	directory string
+	proxy     string
+	host      string
+}
+
+var path_mappings []path_mapping
+
+func init_paths(data map[interface{}]interface{}) {
+	for _, p := range config_list(data, "paths") {
+		m := path_mapping{
+			directory: config_string(p, "directory", ""),
+			proxy:     config_string(p, "proxy", ""),
+			host:      config_string(p, "host", ""),
+		}
+		// unset components are identical to the directory service path
+		if m.proxy == "" {
+			m.proxy = m.directory
+		}
+		if m.host == "" {
+			m.host = m.proxy
+		}
+		for _, path := range []string{m.directory, m.proxy, m.host} {
+			if !filepath.IsAbs(path) || filepath.Clean(path) != path {
+				log.Fatalf("Config: path mapping '%s' must be an absolute and clean path", path)
+			}
+		}
+		log.Printf("Using path mapping: %s -> proxy:%s host:%s", m.directory, m.proxy, m.host)
+		path_mappings = append(path_mappings, m)
+	}
+}
+
+// has_path_prefix checks if path is prefix or a subdirectory of prefix
+func has_path_prefix(path string, prefix string) bool {
+	return path == prefix || prefix == "/" || strings.HasPrefix(path, prefix+"/")
+}
+
+// translate_path returns the proxy and the host view of a directory
+// service path, the longest matching prefix wins
+func translate_path(directory string) (string, string) {
+	directory = filepath.Clean(directory)
+	best := -1
+	for i, m := range path_mappings {
+		if has_path_prefix(directory, m.directory) {
+			if best < 0 || len(m.directory) > len(path_mappings[best].directory) {
+				best = i
+			}
+		}
+	}
+	if best < 0 {
+		return directory, directory
+	}
+	m := path_mappings[best]
+	rest := strings.TrimPrefix(directory, m.directory)
+	return filepath.Join(m.proxy, rest), filepath.Join(m.host, rest)
+}
+
+// proxy_to_host_path converts a path seen by the proxy into the path on
+// the docker host
+func proxy_to_host_path(path string) string {
+	path = filepath.Clean(path)
+	best := -1
+	for i, m := range path_mappings {
+		if has_path_prefix(path, m.proxy) {
+			if best < 0 || len(m.proxy) > len(path_mappings[best].proxy) {
+				best = i
+			}
+		}
+	}
+	if best < 0 {
+		return path
+	}
+	m := path_mappings[best]
+	return filepath.Join(m.host, strings.TrimPrefix(path, m.proxy))
+}
+
+// validate_paths checks at startup that the proxy paths exist and, if
+// the proxy is running inside of a container, that the proxy paths are
+// bind mounts of the configured host paths
+func validate_paths() {
+	if len(path_mappings) == 0 {
+		return
+	}
+
+	for _, m := range path_mappings {
+		if _, err := os.Stat(m.proxy); err != nil {
+			log.Fatalf("Path mapping for %s: proxy path is not accessible (%v)", m.directory, err)
+		}
+	}
+
+	// inside of a container the hostname is the container id
+	hostname, err := os.Hostname()
+	if err != nil {
+		return
+	}
+	data, err := docker.ContainerInspect(context.Background(), hostname)
+	if err != nil {
+		if Debug {
+			log.Printf("Proxy is not running in a container, host paths are not validated")
+		}
+		return
+	}
+
+	for _, m := range path_mappings {
+		validated := false
+		for _, mp := range data.Mounts {
+			if !has_path_prefix(m.proxy, mp.Destination) {
+				continue
+			}
+			rest := strings.TrimPrefix(m.proxy, mp.Destination)
+			if filepath.Join(mp.Source, rest) != m.host {
+				log.Fatalf("Path mapping for %s: %s is mounted from %s, not from %s",
+					m.directory, m.proxy, filepath.Join(mp.Source, rest), m.host)
+			}
+			validated = true
+		}
+		if !validated {
+			log.Printf("Path mapping for %s: %s is not a mount of the proxy container!", m.directory, m.proxy)
+		}
+	}
+}
+
+// public directory components
+var public_directories = []string{"public_html"}
+var public_target string = "/users/{user}/public_html"
+
+func init_public(data map[interface{}]interface{}) {
+	public := config_section(data, "public")
+	if dirs := config_strings(public, "directories"); len(dirs) > 0 {
+		public_directories = dirs
+	}
+	public_target = config_string(public, "target", public_target)
+
+	for _, dir := range public_directories {
+		if dir == "" || filepath.IsAbs(dir) || strings.Contains(dir, "..") {
+			log.Fatalf("Config: public directory '%s' must be relative to the home directory", dir)
+		}
+	}
+	if !filepath.IsAbs(public_target) {
+		log.Fatalf("Config: public target '%s' must be an absolute path", public_target)
+	}
+	log.Printf("Using public directories: %v -> %s", public_directories, public_target)
+}
+
+// FindPublicDirectory returns the first existing candidate directory
+// inside of the home directory
+func FindPublicDirectory(home string) (string, error) {
+	if home == "" {
+		return "", errors.New("no home directory available")
+	}
+	for _, dir := range public_directories {
+		candidate := filepath.Join(home, dir)
+		proxy_path, _ := translate_path(candidate)
+		if finfo, err := os.Stat(proxy_path); err == nil && finfo.IsDir() {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("no public directory %v found in %s", public_directories, home)
+}
@@ -0,0 +1,51 @@
+package doproxy
+
+import "testing"
+
+func TestHasPathPrefix(t *testing.T) {
+	tests := []struct {
+		path, prefix string
+		want         bool
+	}{
+		{"/vol/data", "/vol/data", true},
+		{"/vol/data/sub", "/vol/data", true},
+		{"/vol/database", "/vol/data", false},
+		{"/vol", "/vol/data", false},
+		{"/anything", "/", true},
+	}
+	for _, tt := range tests {
+		if got := has_path_prefix(tt.path, tt.prefix); got != tt.want {
+			t.Errorf("has_path_prefix(%q, %q) = %v, want %v", tt.path, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestTranslatePath(t *testing.T) {
+	old := path_mappings
+	t.Cleanup(func() { path_mappings = old })
+	path_mappings = []path_mapping{
+		{directory: "/home", proxy: "/mnt/home", host: "/export/home"},
+		{directory: "/home/staff", proxy: "/mnt/staff", host: "/export/staff"},
+	}
+
+	tests := []struct {
+		directory, proxy, host string
+	}{
+		{"/home/user/public_html", "/mnt/home/user/public_html", "/export/home/user/public_html"},
+		{"/home/staff/boss", "/mnt/staff/boss", "/export/staff/boss"},
+		{"/home/staffer", "/mnt/home/staffer", "/export/home/staffer"},
+		{"/home/user/../../etc", "/etc", "/etc"},
+		{"/vol/data", "/vol/data", "/vol/data"},
+	}
+	for _, tt := range tests {
+		proxy, host := translate_path(tt.directory)
+		if proxy != tt.proxy || host != tt.host {
+			t.Errorf("translate_path(%q) = %q, %q, want %q, %q", tt.directory, proxy, host, tt.proxy, tt.host)
+		}
+		if tt.proxy != tt.directory {
+			if got := proxy_to_host_path(proxy); got != tt.host {
+				t.Errorf("proxy_to_host_path(%q) = %q, want %q", proxy, got, tt.host)
+			}
+		}
+	}
+}
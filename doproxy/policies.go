@@ -0,0 +1,105 @@
+package doproxy
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// culling policies
+//
+// the idle timeout is taken from the profile of a user (cull_timeout),
+// a pinned profile exempts its sites from every culling and its users
+// are started at boot, the maximum lifetime recycles a container even
+// if it's busy, a pinned site is started again right away
+
+var cull_max_lifetime int = 0 // in seconds, 0 means unlimited
+
+func init_policies(data map[interface{}]interface{}) {
+	section := config_section(data, "cull")
+	cull_max_lifetime = config_int(section, "max_lifetime", cull_max_lifetime)
+
+	for _, profile := range profiles {
+		if profile.pinned {
+			log.Printf("Pinned profile '%s' (users=%v)", profile.name, profile.users)
+			if len(profile.groups) > 0 || len(profile.attributes) > 0 {
+				log.Printf("WARNING: only the users of profile '%s' are started at boot, groups and attributes are matched on request", profile.name)
+			}
+		}
+	}
+}
+
+// container_lifetime returns the maximum lifetime of a container in
+// seconds
+func container_lifetime(pe proxy_service) int {
+	if pe.max_lifetime > 0 {
+		return pe.max_lifetime
+	}
+	return cull_max_lifetime
+}
+
+// lifetime_exceeded checks if a container has to be recycled
+func lifetime_exceeded(pe proxy_service) bool {
+	lifetime := container_lifetime(pe)
+	return lifetime > 0 && pe.ready && time.Since(pe.start) > time.Duration(lifetime)*time.Second
+}
+
+// recycle_container drains and removes a container at the end of its
+// lifetime, pinned sites are spawned again, the caller must have marked
+// the entry with start_drain
+func recycle_container(username string, pe proxy_service) {
+	log.Printf("Recycling container of '%s' after %v ...", username, time.Since(pe.start).Round(time.Second))
+	drain_container(username, pe)
+	if pe.pinned {
+		start_pinned(username)
+	}
+}
+
+// pinned_users returns the users listed in the pinned profiles
+func pinned_users() []string {
+	var users []string
+	for _, profile := range profiles {
+		if profile.pinned {
+			users = append(users, profile.users...)
+		}
+	}
+	return users
+}
+
+// start_site spawns the container of a site without a request, if
+// there is no proxy entry, without evict no other container is evicted
+func start_site(username string, what string, evict bool) bool {
+	proxy := proxy_service{name: username, ready: false, activity: &proxy_activity{}}
+	if _, loaded := proxies.LoadOrStore(username, proxy); loaded {
+		return false
+	}
+	if open, _ := breaker_open(username); open {
+		delete_proxy(username, proxy)
+		return false
+	}
+	log.Printf("Starting %s of '%s' ...", what, username)
+	if err := create_proxy(username, evict); err != nil {
+		delete_proxy(username, proxy)
+		if !errors.Is(err, errUnknownUser) && !errors.Is(err, errBusy) {
+			breaker_failure(username, err.Error())
+		}
+		log.Printf("Starting %s of '%s' failed (%v)", what, username, err)
+		return false
+	}
+	return true
+}
+
+// start_pinned spawns the container of a pinned site
+func start_pinned(username string) {
+	start_site(username, "pinned site", true)
+}
+
+// Service_pinned
+//
+// starts the pinned sites, which are not running, called at boot and
+// by every culling run
+func Service_pinned() {
+	for _, username := range pinned_users() {
+		start_pinned(username)
+	}
+}
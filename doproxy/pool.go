@@ -0,0 +1,249 @@
+package doproxy
+
+import (
+	"context"
+	"log"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// warm pool
+//
+// the cold start is dominated by the creation of the container, the
+// pool keeps created (not started) containers, a spawn finds and starts
+// the container like a stopped one, the size of the pool follows the
+// spawn rate between min and max
+//
+// generic: unassigned containers, which get the mounts of a user on
+//          demand, docker can't add mounts to a created container, so
+//          this mode falls back to per_user
+// per_user: containers of the users with the most traffic in the
+//          access history (see prewarm), users without a container
+
+const (
+	pool_generic  = "generic"
+	pool_per_user = "per_user"
+)
+
+var Pool bool = false
+var Pool_every int = 60
+
+var pool_mode string = pool_per_user
+var pool_min int = 0
+var pool_max int = 10
+var pool_window int = 3600 // seconds of the spawn rate
+var pool_lead int = 600    // seconds of spawns covered by the pool
+
+// times of the spawns within the window
+var spawn_times []time.Time
+var spawn_lock sync.Mutex
+
+// created containers in the pool, user -> container id
+var pooled sync.Map
+
+var metric_pool_created int64
+var metric_pool_hits int64
+var metric_pool_removed int64
+var pool_target int64
+
+func init_pool(data map[interface{}]interface{}) {
+	section := config_section(data, "pool")
+	Pool = config_bool(section, "enabled", Pool)
+	Pool_every = config_int(section, "every", Pool_every)
+	pool_mode = config_string(section, "mode", pool_mode)
+	pool_min = config_int(section, "min", pool_min)
+	pool_max = config_int(section, "max", pool_max)
+	pool_window = config_int(section, "window", pool_window)
+	pool_lead = config_int(section, "lead", pool_lead)
+
+	switch pool_mode {
+	case pool_per_user:
+	case pool_generic:
+		log.Printf("WARNING: a generic pool is not supported by docker, mounts can't be attached to a created container, using per_user")
+		pool_mode = pool_per_user
+	default:
+		log.Fatalf("Config: unknown pool mode '%s', only per_user|generic are allowed", pool_mode)
+	}
+	if pool_min < 0 || pool_max < pool_min || pool_window <= 0 {
+		log.Fatalf("Config: invalid pool size %d..%d or window %d", pool_min, pool_max, pool_window)
+	}
+
+	if !Pool {
+		return
+	}
+	log.Printf("Warm pool: %s, %d..%d containers, spawns of %ds cover %ds", pool_mode, pool_min, pool_max, pool_window, pool_lead)
+}
+
+// record_spawn counts a spawn for the spawn rate
+func record_spawn() {
+	if !Pool {
+		return
+	}
+	spawn_lock.Lock()
+	spawn_times = append(spawn_times, time.Now())
+	spawn_lock.Unlock()
+}
+
+// spawn_rate returns the spawns per second within the window
+func spawn_rate() float64 {
+	spawn_lock.Lock()
+	defer spawn_lock.Unlock()
+
+	start := time.Now().Add(-time.Duration(pool_window) * time.Second)
+	i := 0
+	for i < len(spawn_times) && spawn_times[i].Before(start) {
+		i++
+	}
+	spawn_times = spawn_times[i:]
+	return float64(len(spawn_times)) / float64(pool_window)
+}
+
+// pool_size returns the target size of the pool
+func pool_size() int {
+	size := int(math.Ceil(spawn_rate() * float64(pool_lead)))
+	if size < pool_min {
+		size = pool_min
+	}
+	if size > pool_max {
+		size = pool_max
+	}
+	atomic.StoreInt64(&pool_target, int64(size))
+	return size
+}
+
+// pool_hit is called when a spawn uses an existing container
+func pool_hit(username string, container_id string) {
+	if result, ok := pooled.Load(username); ok && result.(string) == container_id {
+		pooled.Delete(username)
+		count_metric(&metric_pool_hits)
+		log.Printf("Container of '%s' taken from the warm pool!", username)
+	}
+}
+
+// scan_pool reads the pooled containers from docker, the pool survives
+// a restart of the proxy
+func scan_pool() int {
+	containers, err := ListUserContainers("", true)
+	if err != nil {
+		log.Printf("Can't read the list of containers (%v)", err)
+		return -1
+	}
+	pooled.Range(func(key any, value any) bool {
+		pooled.Delete(key)
+		return true
+	})
+	size := 0
+	for _, c := range containers {
+		username := c.Labels[label_user]
+		if c.State != "created" || c.Labels[label_pool] == "" || username == "" {
+			continue
+		}
+		if _, ok := proxies.Load(username); ok {
+			continue
+		}
+		pooled.Store(username, c.ID)
+		size++
+	}
+	return size
+}
+
+// pool_candidates returns users with traffic, without a proxy entry
+// and without a container
+func pool_candidates(n int) []string {
+	hour := time.Now().Unix() / 3600
+	var users []string
+	for _, username := range rank_users(math.MaxInt32, math.SmallestNonzeroFloat64, func(h *access_history) float64 {
+		return history_total(h, hour)
+	}) {
+		if len(users) >= n {
+			break
+		}
+		if _, ok := proxies.Load(username); ok {
+			continue
+		}
+		if containers, err := ListUserContainers(username, true); err != nil || len(containers) > 0 {
+			continue
+		}
+		users = append(users, username)
+	}
+	return users
+}
+
+// pool_create creates a container of a user without starting it
+func pool_create(username string) {
+	if open, _ := breaker_open(username); open {
+		return
+	}
+	spec, err := build_container(username)
+	if err != nil {
+		log.Printf("Can't create the pool container of '%s' (%v)", username, err)
+		return
+	}
+	spec.config.Labels[label_pool] = "true"
+	container_id, err := create_container(username, spec)
+	if err != nil {
+		log.Printf("Can't create the pool container of '%s' (%v)", username, err)
+		remove_user_network(username)
+		return
+	}
+	pooled.Store(username, container_id)
+	count_metric(&metric_pool_created)
+	log.Printf("Pool container of '%s' created!", username)
+}
+
+// pool_remove removes a pooled container, a started container is
+// not removed
+func pool_remove(username string, container_id string) {
+	pooled.Delete(username)
+	err := docker.ContainerRemove(context.Background(), container_id, types.ContainerRemoveOptions{})
+	if err != nil {
+		log.Printf("Can't remove the pool container of '%s' (%v)", username, err)
+		return
+	}
+	remove_user_network(username)
+	count_metric(&metric_pool_removed)
+	log.Printf("Pool container of '%s' removed!", username)
+}
+
+// Service_pool
+//
+// fills or shrinks the warm pool to the size given by the spawn rate
+func Service_pool() {
+	size := scan_pool()
+	if size < 0 {
+		return
+	}
+	target := pool_size()
+	if Debug {
+		log.Printf("Warm pool: %d containers, target %d", size, target)
+	}
+
+	if size < target {
+		for _, username := range pool_candidates(target - size) {
+			pool_create(username)
+		}
+	} else if size > target {
+		pooled.Range(func(key any, value any) bool {
+			if size <= target {
+				return false
+			}
+			pool_remove(key.(string), value.(string))
+			size--
+			return true
+		})
+	}
+}
+
+// pool_length returns the number of pooled containers
+func pool_length() int {
+	size := 0
+	pooled.Range(func(key any, value any) bool {
+		size++
+		return true
+	})
+	return size
+}
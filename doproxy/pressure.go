@@ -0,0 +1,178 @@
+package doproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// host pressure culling
+//
+// an additional culling service reads the memory pressure of the host,
+// if a threshold is crossed the least recently used containers are
+// culled before their timeout, the host memory is read from
+// /proc/meminfo and /proc/pressure/memory or from the docker daemon
+
+var Pressure bool = false
+var Pressure_every int = 30
+
+var pressure_source string = "proc"
+var pressure_min_available float64 = 10 // percent of the total memory
+var pressure_psi_some float64 = 0       // memory PSI some avg10, 0 disables
+var pressure_evict int = 2              // containers per run
+var pressure_min_idle int = 60          // seconds
+
+func init_pressure(data map[interface{}]interface{}) {
+	section := config_section(data, "pressure")
+	Pressure = config_bool(section, "enabled", Pressure)
+	Pressure_every = config_int(section, "every", Pressure_every)
+	pressure_source = config_string(section, "source", pressure_source)
+	pressure_min_available = config_float(section, "min_available", pressure_min_available)
+	pressure_psi_some = config_float(section, "psi_some_avg10", pressure_psi_some)
+	pressure_evict = config_int(section, "evict", pressure_evict)
+	pressure_min_idle = config_int(section, "min_idle", pressure_min_idle)
+
+	switch pressure_source {
+	case "proc", "docker":
+	default:
+		log.Fatalf("Config: unknown pressure source '%s', only proc|docker are allowed", pressure_source)
+	}
+	if Pressure {
+		log.Printf("Pressure culling: every %ds, min available %.1f%%, PSI %.1f (%s)",
+			Pressure_every, pressure_min_available, pressure_psi_some, pressure_source)
+	}
+
+	// the docker source only counts the memory limits, containers
+	// without a limit are invisible
+	if Pressure && pressure_source == "docker" {
+		unlimited := default_resources.memory == 0
+		for _, profile := range profiles {
+			unlimited = unlimited || profile.resources.memory == 0
+		}
+		if unlimited {
+			log.Printf("WARNING: pressure source docker without a memory limit, the containers without a limit are not counted!")
+		}
+	}
+}
+
+// read_meminfo returns the total and the available memory in kB
+func read_meminfo() (int64, int64, error) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	var total, available int64 = -1, -1
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		value, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total = value
+		case "MemAvailable:":
+			available = value
+		}
+	}
+	if total <= 0 || available < 0 {
+		return 0, 0, errors.New("no MemTotal/MemAvailable in /proc/meminfo")
+	}
+	return total, available, scanner.Err()
+}
+
+// read_psi returns the avg10 value of the "some" line of the memory
+// pressure stall information
+func read_psi() (float64, error) {
+	content, err := os.ReadFile("/proc/pressure/memory")
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "some" {
+			continue
+		}
+		for _, field := range fields[1:] {
+			if strings.HasPrefix(field, "avg10=") {
+				return strconv.ParseFloat(strings.TrimPrefix(field, "avg10="), 64)
+			}
+		}
+	}
+	return 0, errors.New("no some avg10 in /proc/pressure/memory")
+}
+
+// docker_available estimates the available memory from the total memory
+// of the docker host and the memory limits of the running containers
+func docker_available() (int64, int64, error) {
+	info, err := docker.Info(context.Background())
+	if err != nil {
+		return 0, 0, err
+	}
+	_, used := capacity_usage("")
+	return info.MemTotal, info.MemTotal - used, nil
+}
+
+// host_under_pressure checks the thresholds
+func host_under_pressure() (bool, string) {
+	var total, available int64
+	var err error
+	if pressure_source == "docker" {
+		total, available, err = docker_available()
+	} else {
+		total, available, err = read_meminfo()
+	}
+	if err != nil {
+		log.Printf("Can't read the host memory (%v)", err)
+	} else if percent := 100 * float64(available) / float64(total); percent < pressure_min_available {
+		return true, fmt.Sprintf("%.1f%% memory available", percent)
+	}
+
+	if pressure_psi_some > 0 && pressure_source == "proc" {
+		psi, err := read_psi()
+		if err != nil {
+			log.Printf("Can't read the memory pressure (%v)", err)
+		} else if psi > pressure_psi_some {
+			return true, fmt.Sprintf("memory PSI some avg10=%.2f", psi)
+		}
+	}
+	return false, ""
+}
+
+// Service_pressure_culling
+//
+// culls the least recently used containers while the host is under
+// memory pressure
+func Service_pressure_culling() {
+	pressure, reason := host_under_pressure()
+	if !pressure {
+		return
+	}
+	log.Printf("Host under pressure (%s), culling up to %d containers ...", reason, pressure_evict)
+
+	for i := 0; i < pressure_evict; i++ {
+		username, pe, ok := lru_candidate("")
+		if !ok || pe.activity.idle(pe.last) < time.Duration(pressure_min_idle)*time.Second {
+			log.Printf("No more idle containers for the pressure culling!")
+			break
+		}
+		if !pe.activity.start_drain() {
+			continue
+		}
+		log.Printf("Pressure culling of '%s' ...", username)
+		count_metric(&metric_pressure_evictions)
+		drain_container(username, pe)
+	}
+}
@@ -0,0 +1,316 @@
+package doproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-co-op/gocron"
+)
+
+// predictive pre-warming
+//
+// the requests of every user are counted in hourly slots of a week, the
+// slots decay every week, so recent traffic weighs more, the top users
+// of the coming hour are started before their visitors arrive, the
+// schedules start listed users at fixed times (e.g. monday morning),
+// a pre-warmed container counts as hit if it gets a request before it
+// is culled, otherwise as wasted
+
+const history_slots = 7 * 24
+
+type access_history struct {
+	Slots [history_slots]float64 `json:"slots"`
+	Last  int64                  `json:"last"` // hours since the epoch of the last request
+	Seen  int64                  `json:"seen"` // time of the last request in unix seconds
+}
+
+type prewarm_schedule struct {
+	name  string
+	cron  string
+	users []string
+}
+
+var Prewarm bool = false
+var Prewarm_every int = 600
+
+// the access history is saved to the history_file
+var History bool = false
+
+var prewarm_top int = 0
+var prewarm_min_score float64 = 1
+var prewarm_decay float64 = 0.5
+var prewarm_history_file string = ""
+var prewarm_schedules []prewarm_schedule
+
+var history map[string]*access_history = map[string]*access_history{}
+var history_lock sync.Mutex
+
+// pre-warmed containers without a request yet
+var prewarmed sync.Map
+
+var metric_prewarm_starts int64
+var metric_prewarm_hits int64
+var metric_prewarm_wasted int64
+
+func init_prewarm(data map[interface{}]interface{}) {
+	section := config_section(data, "prewarm")
+	Prewarm = config_bool(section, "enabled", Prewarm)
+	Prewarm_every = config_int(section, "every", Prewarm_every)
+	prewarm_top = config_int(section, "top", prewarm_top)
+	prewarm_min_score = config_float(section, "min_score", prewarm_min_score)
+	prewarm_decay = config_float(section, "decay", prewarm_decay)
+	prewarm_history_file = config_string(section, "history_file", prewarm_history_file)
+
+	if prewarm_decay <= 0 || prewarm_decay > 1 {
+		log.Fatalf("Config: prewarm decay must be between 0 and 1 (got %.2f)", prewarm_decay)
+	}
+
+	for i, p := range config_list(section, "schedules") {
+		schedule := prewarm_schedule{
+			name:  config_string(p, "name", fmt.Sprintf("schedule%d", i+1)),
+			cron:  config_string(p, "cron", ""),
+			users: config_strings(p, "users"),
+		}
+		if schedule.cron == "" || len(schedule.users) == 0 {
+			log.Fatalf("Config: prewarm schedule '%s' needs a cron expression and users", schedule.name)
+		}
+		prewarm_schedules = append(prewarm_schedules, schedule)
+	}
+
+	// the history is kept for the last access of adopted containers,
+	// even without pre-warming
+	History = prewarm_history_file != ""
+	load_history()
+
+	if !Prewarm {
+		return
+	}
+	log.Printf("Pre-warming: top %d users every %ds, %d schedules (history: %s)",
+		prewarm_top, Prewarm_every, len(prewarm_schedules), prewarm_history_file)
+}
+
+func history_slot(hour int64) int {
+	// the epoch started on a thursday
+	return int((hour + 4*24) % history_slots)
+}
+
+// record_access counts a request of a user, the slots passed since the
+// last request decay
+func record_access(username string) {
+	if !Prewarm && !Pool && !History {
+		return
+	}
+	hour := time.Now().Unix() / 3600
+
+	history_lock.Lock()
+	defer history_lock.Unlock()
+
+	h, ok := history[username]
+	if !ok {
+		h = &access_history{Last: hour}
+		history[username] = h
+	}
+	for t := h.Last + 1; t <= hour && t <= h.Last+history_slots; t++ {
+		h.Slots[history_slot(t)] *= prewarm_decay
+	}
+	h.Last = hour
+	h.Seen = time.Now().Unix()
+	h.Slots[history_slot(hour)]++
+}
+
+// last_access returns the time of the last request of a user from the
+// access history
+func last_access(username string) (time.Time, bool) {
+	history_lock.Lock()
+	defer history_lock.Unlock()
+	if h, ok := history[username]; ok && h.Seen > 0 {
+		return time.Unix(h.Seen, 0), true
+	}
+	return time.Time{}, false
+}
+
+// history_score returns the expected traffic of a user in an hour
+func history_score(h *access_history, hour int64) float64 {
+	score := h.Slots[history_slot(hour)]
+	// slots which were not updated for weeks
+	for weeks := (hour - h.Last) / history_slots; weeks > 0 && score > 0; weeks-- {
+		score *= prewarm_decay
+	}
+	return score
+}
+
+// history_total returns the traffic of a user in a whole week
+func history_total(h *access_history, hour int64) float64 {
+	total := 0.0
+	for slot := int64(0); slot < history_slots; slot++ {
+		total += history_score(h, hour-slot)
+	}
+	return total
+}
+
+// top_users returns the users with the highest expected traffic in
+// the coming hour
+func top_users(n int) []string {
+	hour := time.Now().Add(time.Duration(Prewarm_every)*time.Second).Unix() / 3600
+	return rank_users(n, prewarm_min_score, func(h *access_history) float64 {
+		return history_score(h, hour)
+	})
+}
+
+// rank_users returns the n users with the highest scores
+func rank_users(n int, min_score float64, score_func func(*access_history) float64) []string {
+	type candidate struct {
+		username string
+		score    float64
+	}
+	var candidates []candidate
+
+	history_lock.Lock()
+	for username, h := range history {
+		if score := score_func(h); score >= min_score {
+			candidates = append(candidates, candidate{username, score})
+		}
+	}
+	history_lock.Unlock()
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].score > candidates[j].score })
+
+	var users []string
+	for i := 0; i < len(candidates) && i < n; i++ {
+		users = append(users, candidates[i].username)
+	}
+	return users
+}
+
+// prewarm_users starts the containers of users, which are not running,
+// a pre-warmed container only uses free capacity and never evicts
+// another container, the check before the spawn with the default
+// memory only ends the run early
+func prewarm_users(users []string) {
+	for _, username := range users {
+		if _, ok := proxies.Load(username); ok {
+			continue
+		}
+		if !capacity_available(username, default_resources.memory) {
+			log.Printf("Pre-warming stopped, no capacity left!")
+			return
+		}
+		if start_site(username, "pre-warmed site", false) {
+			prewarmed.Store(username, time.Now())
+			count_metric(&metric_prewarm_starts)
+		}
+	}
+}
+
+// prewarm_hit is called for every request of a site
+func prewarm_hit(username string) {
+	if _, ok := prewarmed.LoadAndDelete(username); ok {
+		count_metric(&metric_prewarm_hits)
+		if Debug {
+			log.Printf("Pre-warmed site of '%s' was visited!", username)
+		}
+	}
+}
+
+// prewarm_culled is called when a container is culled
+func prewarm_culled(username string) {
+	if _, ok := prewarmed.LoadAndDelete(username); ok {
+		count_metric(&metric_prewarm_wasted)
+		log.Printf("Pre-warmed site of '%s' was culled without a visit!", username)
+	}
+}
+
+// prewarm_hit_rate returns the share of visited pre-warmed containers
+func prewarm_hit_rate() float64 {
+	hits := atomic.LoadInt64(&metric_prewarm_hits)
+	wasted := atomic.LoadInt64(&metric_prewarm_wasted)
+	if hits+wasted == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+wasted)
+}
+
+func load_history() {
+	if prewarm_history_file == "" {
+		return
+	}
+	content, err := os.ReadFile(prewarm_history_file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Can't read the access history (%v)", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(content, &history); err != nil {
+		log.Printf("Can't parse the access history (%v)", err)
+		history = map[string]*access_history{}
+		return
+	}
+	log.Printf("Access history of %d users loaded!", len(history))
+}
+
+func save_history() {
+	if prewarm_history_file == "" {
+		return
+	}
+	history_lock.Lock()
+	content, err := json.Marshal(history)
+	history_lock.Unlock()
+	if err != nil {
+		log.Printf("Can't encode the access history (%v)", err)
+		return
+	}
+	// replace the file atomically
+	tmp := prewarm_history_file + ".tmp"
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		log.Printf("Can't write the access history (%v)", err)
+		return
+	}
+	if err := os.Rename(tmp, prewarm_history_file); err != nil {
+		log.Printf("Can't write the access history (%v)", err)
+	}
+}
+
+// Service_prewarm
+//
+// starts the sites of the top users of the coming hour
+func Service_prewarm() {
+	if prewarm_top > 0 {
+		users := top_users(prewarm_top)
+		if Debug {
+			log.Printf("Pre-warming candidates: %v", users)
+		}
+		prewarm_users(users)
+	}
+}
+
+// Service_history
+//
+// saves the access history to the history_file
+func Service_history() {
+	save_history()
+}
+
+// Schedule_prewarm
+//
+// adds the pre-warming service and the schedules to the scheduler, the
+// schedules use the timezone of the culling windows
+func Schedule_prewarm(s *gocron.Scheduler) {
+	st := time.Now().Add(time.Second * time.Duration(Prewarm_every))
+	if _, err := s.Every(Prewarm_every).Seconds().StartAt(st).Do(Service_prewarm); err != nil {
+		log.Fatalf("Can't schedule the pre-warming (%v)", err)
+	}
+	for _, schedule := range prewarm_schedules {
+		expression := fmt.Sprintf("CRON_TZ=%s %s", culling_location, schedule.cron)
+		if _, err := s.Cron(expression).Do(prewarm_users, schedule.users); err != nil {
+			log.Fatalf("Can't schedule pre-warming '%s' (%v)", schedule.name, err)
+		}
+		log.Printf("Pre-warming '%s' at '%s' for %v", schedule.name, schedule.cron, schedule.users)
+	}
+}
@@ -0,0 +1,68 @@
+package doproxy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHistoryScore(t *testing.T) {
+	old := prewarm_decay
+	t.Cleanup(func() { prewarm_decay = old })
+	prewarm_decay = 0.5
+
+	hour := int64(500000)
+	tests := []struct {
+		last int64
+		want float64
+	}{
+		{last: hour, want: 8},
+		{last: hour - 1, want: 8},
+		{last: hour - history_slots, want: 4},
+		{last: hour - 3*history_slots, want: 1},
+	}
+	for _, tt := range tests {
+		h := &access_history{Last: tt.last}
+		h.Slots[history_slot(hour)] = 8
+		if got := history_score(h, hour); got != tt.want {
+			t.Errorf("history_score with the last request %d hours ago = %v, want %v", hour-tt.last, got, tt.want)
+		}
+	}
+
+	// the same hour of the next week
+	h := &access_history{Last: hour}
+	h.Slots[history_slot(hour)] = 8
+	if got := history_score(h, hour+history_slots); got != 4 {
+		t.Errorf("history_score a week later = %v, want 4", got)
+	}
+}
+
+func TestRankUsers(t *testing.T) {
+	old := history
+	t.Cleanup(func() { history = old })
+	history = map[string]*access_history{}
+
+	scores := map[string]float64{"alice": 3, "bob": 7, "carol": 0.5, "dave": 5}
+	for username, score := range scores {
+		h := &access_history{}
+		h.Slots[0] = score
+		history[username] = h
+	}
+	score := func(h *access_history) float64 { return h.Slots[0] }
+
+	tests := []struct {
+		n         int
+		min_score float64
+		want      []string
+	}{
+		{n: 2, min_score: 1, want: []string{"bob", "dave"}},
+		{n: 10, min_score: 1, want: []string{"bob", "dave", "alice"}},
+		{n: 10, min_score: 0, want: []string{"bob", "dave", "alice", "carol"}},
+		{n: 10, min_score: 10, want: nil},
+		{n: 0, min_score: 0, want: nil},
+	}
+	for _, tt := range tests {
+		if got := rank_users(tt.n, tt.min_score, score); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("rank_users(%d, %v) = %v, want %v", tt.n, tt.min_score, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package doproxy
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// site profiles
+//
+// a profile describes the container settings for a group of users,
+// the first profile matching a user by name, group or directory
+// attribute wins, otherwise the default profile built from the docker
+// section is used
+
+type site_profile struct {
+	name string
+	// matching rules
+	users      []string
+	groups     []string
+	attributes map[string]string
+	// container settings
+	image        string
+	resources    resource_limits
+	env          []string
+	cull_timeout int  // in seconds, 0 means the global timeout
+	max_lifetime int  // in seconds, 0 means the global lifetime
+	pinned       bool // never culled, started at boot
+}
+
+// informations about a user delivered by the info providers
+type user_infos struct {
+	home        string              // home directory
+	public      string              // public directory, if given by the provider
+	directories []string            // additional directories
+	uid         string              // numeric user id
+	gid         string              // numeric primary group id
+	gids        []string            // numeric supplementary group ids
+	groups      []string            // group names
+	attributes  map[string][]string // directory attributes for the profile matching
+}
+
+var profiles []site_profile
+
+func init_profiles(data map[interface{}]interface{}) {
+	for _, p := range config_list(data, "profiles") {
+		profile := site_profile{
+			name:         config_string(p, "name", ""),
+			users:        config_strings(p, "users"),
+			groups:       config_strings(p, "groups"),
+			attributes:   config_string_map(p, "attributes"),
+			image:        config_string(p, "image", ""),
+			resources:    config_resources(p, default_resources),
+			env:          config_strings(p, "env"),
+			cull_timeout: config_int(p, "cull_timeout", 0),
+			max_lifetime: config_int(p, "max_lifetime", 0),
+			pinned:       config_bool(p, "pinned", false),
+		}
+		if profile.name == "" {
+			log.Fatalf("Config: every profile needs a name")
+		}
+		log.Printf("Using profile '%s' (users=%v groups=%v attributes=%v)",
+			profile.name, profile.users, profile.groups, profile.attributes)
+		profiles = append(profiles, profile)
+	}
+}
+
+// profile_attributes returns the names of all directory attributes
+// which are needed for the profile matching
+func profile_attributes() []string {
+	var attributes []string
+	for _, profile := range profiles {
+		for attr := range profile.attributes {
+			attributes = append(attributes, attr)
+		}
+	}
+	return attributes
+}
+
+func contains_string(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (profile site_profile) matches(username string, infos user_infos) bool {
+	if contains_string(profile.users, username) {
+		return true
+	}
+	for _, group := range infos.groups {
+		if contains_string(profile.groups, group) {
+			return true
+		}
+	}
+	for attr, value := range profile.attributes {
+		for _, v := range infos.attributes[attr] {
+			if strings.EqualFold(v, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// default_profile creates the profile from the global docker settings
+func default_profile() site_profile {
+	return site_profile{name: "default", image: docker_image, resources: default_resources}
+}
+
+// complete_profile fills the unset values of a profile from the
+// default profile
+func complete_profile(profile site_profile) site_profile {
+	result := default_profile()
+	result.name = profile.name
+	if profile.image != "" {
+		result.image = profile.image
+	}
+	result.resources = profile.resources
+	result.env = profile.env
+	result.cull_timeout = profile.cull_timeout
+	result.max_lifetime = profile.max_lifetime
+	result.pinned = profile.pinned
+	return result
+}
+
+// select_profile returns the settings for a user, the first matching
+// profile wins
+func select_profile(username string, infos user_infos) site_profile {
+	result := default_profile()
+	for _, profile := range profiles {
+		if profile.matches(username, infos) {
+			result = complete_profile(profile)
+			break
+		}
+	}
+	if Debug {
+		log.Printf("Profile for '%s': %s (image=%s)", username, result.name, result.image)
+	}
+	return result
+}
+
+// container_user returns the uid:gid for the container of a user, the
+// image user is only used if run_as_root is set
+func container_user(username string, infos user_infos) (string, error) {
+	if docker_run_as_root {
+		return "", nil
+	}
+	if infos.uid == "" || infos.gid == "" {
+		return "", fmt.Errorf("no uid/gid known for '%s'", username)
+	}
+	if infos.uid == "0" {
+		return "", fmt.Errorf("refusing to run the container of '%s' as root", username)
+	}
+	return fmt.Sprintf("%s:%s", infos.uid, infos.gid), nil
+}
+
+// profile_by_name returns a configured profile, unknown names return
+// the default profile
+func profile_by_name(name string) site_profile {
+	for _, profile := range profiles {
+		if profile.name == name {
+			return complete_profile(profile)
+		}
+	}
+	return default_profile()
+}
@@ -0,0 +1,129 @@
+package doproxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Service_reconcile
+//
+// adopts the running containers of this proxy instance after a restart,
+// the proxy entries are rebuilt from the container labels, broken
+// containers are removed
+func Service_reconcile() {
+	log.Printf("Reconciliation started ...")
+	report_foreign_containers()
+
+	containers, err := ListUserContainers("", true)
+	if err != nil {
+		log.Printf("Can't read the list of containers (%v)", err)
+		return
+	}
+
+	adopted, kept, removed, failed := 0, 0, 0, 0
+
+	remove := func(username string, container_id string, reason string) {
+		log.Printf("Reconciliation: removing container of '%s' (%s)", username, reason)
+		if err := RemoveContainer(username, container_id); err != nil {
+			log.Printf("Removing container for '%s' failed (%v)", username, err)
+			failed++
+		} else {
+			removed++
+		}
+	}
+
+	for _, c := range containers {
+		username := c.Labels[label_user]
+		if username == "" {
+			continue
+		}
+
+		if _, ok := proxies.Load(username); ok {
+			remove(username, c.ID, "duplicate container")
+			continue
+		}
+
+		data, err := docker.ContainerInspect(context.Background(), c.ID)
+		if err != nil {
+			remove(username, c.ID, fmt.Sprintf("inspect failed: %v", err))
+			continue
+		}
+		if is_crash_loop(data) || c.State == "dead" {
+			remove(username, c.ID, fmt.Sprintf("state %s, %d restarts", c.State, data.RestartCount))
+			continue
+		}
+
+		// a restarted proxy container has to join the per-user network
+		// again, otherwise the container can't be reached
+		if err := prepare_user_network(username); err != nil {
+			remove(username, c.ID, fmt.Sprintf("network failed: %v", err))
+			continue
+		}
+
+		// stopped containers are started again by the next request
+		if c.State != "running" {
+			if Debug {
+				log.Printf("Reconciliation: keeping %s container of '%s'", c.State, username)
+			}
+			kept++
+			continue
+		}
+
+		ip_addr := container_address(username, data)
+		if ip_addr == "" {
+			remove(username, c.ID, "no IP address")
+			continue
+		}
+
+		url := fmt.Sprintf("http://%s/", ip_addr)
+		np, err := NewProxy(url)
+		if err != nil {
+			remove(username, c.ID, err.Error())
+			continue
+		}
+
+		// restore the metadata from the labels, the last access from
+		// the access history (with a history_file), otherwise the culling timeout starts now, the request count
+		// starts at 0
+		start, err := time.Parse(time.RFC3339, c.Labels[label_spawned])
+		if err != nil {
+			start = time.Unix(c.Created, 0)
+		}
+		profile := profile_by_name(c.Labels[label_profile])
+		last := time.Now()
+		if seen, ok := last_access(username); ok && seen.After(start) {
+			last = seen
+		}
+
+		pe := proxy_service{
+			name:         username,
+			ready:        true,
+			state:        state_running,
+			url:          url,
+			proxy:        np,
+			start:        start,
+			container_id: c.ID,
+			profile:      profile.name,
+			cull_timeout: profile.cull_timeout,
+			max_lifetime: profile.max_lifetime,
+			pinned:       profile.pinned,
+			memory:       profile.resources.memory,
+			last:         last,
+			verified:     time.Now(),
+			activity:     &proxy_activity{},
+			count:        0,
+		}
+		proxies.Store(username, pe)
+		adopted++
+
+		if Debug {
+			log.Printf("Reconciliation: adopted container of '%s' (%s, profile %s, started %v, last access %v)",
+				username, url, profile.name, start, last)
+		}
+	}
+
+	log.Printf("Reconciliation finished: %d containers adopted, %d kept stopped, %d removed, %d failed!",
+		adopted, kept, removed, failed)
+}
@@ -0,0 +1,136 @@
+package doproxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-units"
+)
+
+// resource limits
+//
+// the defaults from the resources section are used for every container,
+// profiles can override single values
+
+type resource_limits struct {
+	memory       int64   // in bytes, 0 means no limit
+	memory_swap  int64   // memory+swap in bytes, 0 means docker default, -1 unlimited
+	cpus         float64 // number of cpus, 0 means no limit
+	cpu_shares   int64   // relative weight, 0 means docker default
+	blkio_weight uint16  // 10..1000, 0 means docker default
+	ulimits      []*units.Ulimit
+}
+
+var default_resources resource_limits
+
+// number of oom kills per user
+var oom_kills sync.Map
+
+// containers with oom kills already reported by the events watcher
+var oom_reported sync.Map
+
+func init_resources(data map[interface{}]interface{}) {
+	default_resources = config_resources(config_section(data, "resources"), resource_limits{})
+	log.Printf("Default resources: memory=%d memory_swap=%d cpus=%.2f cpu_shares=%d blkio_weight=%d",
+		default_resources.memory, default_resources.memory_swap, default_resources.cpus,
+		default_resources.cpu_shares, default_resources.blkio_weight)
+}
+
+// config_resources reads the resource limits of a section, unset values
+// are taken from defaults
+func config_resources(section map[interface{}]interface{}, defaults resource_limits) resource_limits {
+	r := defaults
+	r.memory = config_size(section, "memory", r.memory)
+	r.memory_swap = config_size(section, "memory_swap", r.memory_swap)
+	r.cpus = config_float(section, "cpus", r.cpus)
+	r.cpu_shares = int64(config_int(section, "cpu_shares", int(r.cpu_shares)))
+
+	weight := config_int(section, "blkio_weight", int(r.blkio_weight))
+	if weight != 0 && (weight < 10 || weight > 1000) {
+		log.Fatalf("Config: blkio_weight must be between 10 and 1000 (got %d)", weight)
+	}
+	r.blkio_weight = uint16(weight)
+
+	// docker refuses a swap limit without a memory limit
+	if r.memory_swap > 0 && r.memory == 0 {
+		log.Fatalf("Config: memory_swap needs a memory limit")
+	}
+	if r.memory_swap > 0 && r.memory_swap < r.memory {
+		log.Fatalf("Config: memory_swap must be at least memory")
+	}
+
+	if ulimits := config_string_map(section, "ulimits"); len(ulimits) > 0 {
+		r.ulimits = nil
+		for name, value := range ulimits {
+			ulimit, err := parse_ulimit(name, value)
+			if err != nil {
+				log.Fatalf("Config: %v", err)
+			}
+			r.ulimits = append(r.ulimits, ulimit)
+		}
+		// a stable order keeps the config hash stable across restarts
+		sort.Slice(r.ulimits, func(i, j int) bool { return r.ulimits[i].Name < r.ulimits[j].Name })
+	}
+	return r
+}
+
+// parse_ulimit reads limits like nofile: 1024 or nofile: 1024:2048
+func parse_ulimit(name string, value string) (*units.Ulimit, error) {
+	soft_s, hard_s, has_hard := strings.Cut(value, ":")
+	soft, err := strconv.ParseInt(soft_s, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ulimit %s=%s", name, value)
+	}
+	hard := soft
+	if has_hard {
+		hard, err = strconv.ParseInt(hard_s, 10, 64)
+		if err != nil || hard < soft {
+			return nil, fmt.Errorf("invalid ulimit %s=%s", name, value)
+		}
+	}
+	return &units.Ulimit{Name: name, Soft: soft, Hard: hard}, nil
+}
+
+// apply_resources sets the limits in the host config
+func apply_resources(hostConfig *container.HostConfig, r resource_limits) {
+	hostConfig.Resources.Memory = r.memory
+	hostConfig.Resources.MemorySwap = r.memory_swap
+	hostConfig.Resources.NanoCPUs = int64(r.cpus * 1e9)
+	hostConfig.Resources.CPUShares = r.cpu_shares
+	hostConfig.Resources.BlkioWeight = r.blkio_weight
+	hostConfig.Resources.Ulimits = r.ulimits
+}
+
+// record_oom counts and reports an oom kill of a user container
+func record_oom(username string) {
+	count := int64(1)
+	if n, ok := oom_kills.Load(username); ok {
+		count += n.(int64)
+	}
+	oom_kills.Store(username, count)
+	log.Printf("OOM: container of '%s' was killed by the kernel (%d times)", username, count)
+}
+
+// check_oom inspects a container before it is removed and reports an
+// oom kill, which was not reported by the events watcher
+func check_oom(username string, container_id string) {
+	if container_id == "" {
+		return
+	}
+	if _, ok := oom_reported.LoadAndDelete(container_id); ok {
+		return
+	}
+	data, err := docker.ContainerInspect(context.Background(), container_id)
+	if err != nil || data.State == nil {
+		return
+	}
+	if data.State.OOMKilled {
+		record_oom(username)
+	}
+}
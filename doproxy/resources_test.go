@@ -0,0 +1,41 @@
+package doproxy
+
+import "testing"
+
+func TestParseUlimit(t *testing.T) {
+	tests := []struct {
+		value      string
+		soft, hard int64
+		invalid    bool
+	}{
+		{value: "1024", soft: 1024, hard: 1024},
+		{value: "1024:2048", soft: 1024, hard: 2048},
+		{value: "2048:1024", invalid: true},
+		{value: "many", invalid: true},
+		{value: "1024:", invalid: true},
+	}
+	for _, tt := range tests {
+		got, err := parse_ulimit("nofile", tt.value)
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("parse_ulimit(%q) = %+v, want an error", tt.value, got)
+			}
+			continue
+		}
+		if err != nil || got.Name != "nofile" || got.Soft != tt.soft || got.Hard != tt.hard {
+			t.Errorf("parse_ulimit(%q) = %+v, %v, want %d:%d", tt.value, got, err, tt.soft, tt.hard)
+		}
+	}
+}
+
+func TestConfigResourcesUlimitOrder(t *testing.T) {
+	section := map[interface{}]interface{}{
+		"ulimits": map[interface{}]interface{}{"nproc": "512", "nofile": "1024", "core": "0"},
+	}
+	for i := 0; i < 20; i++ {
+		r := config_resources(section, resource_limits{})
+		if len(r.ulimits) != 3 || r.ulimits[0].Name != "core" || r.ulimits[1].Name != "nofile" || r.ulimits[2].Name != "nproc" {
+			t.Fatalf("ulimits are not sorted: %v", r.ulimits)
+		}
+	}
+}
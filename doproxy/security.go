@@ -0,0 +1,139 @@
+package doproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// security profile
+//
+// hardening of the user containers, the defaults are strict and every
+// weakened setting is reported at startup
+
+var security_read_only bool = true
+var security_tmpfs = []string{"/tmp", "/run"}
+var security_tmpfs_options string = "rw,noexec,nosuid,nodev,size=64m"
+var security_cap_drop = []string{"ALL"}
+var security_cap_add []string
+var security_no_new_privileges bool = true
+var security_pids_limit int64 = 256
+var security_seccomp string = ""
+var security_apparmor string = ""
+
+// the content of a custom seccomp profile file
+var security_seccomp_json string = ""
+
+// capabilities which allow to escape or attack the host
+var dangerous_capabilities = []string{"SYS_ADMIN", "SYS_MODULE", "SYS_PTRACE", "SYS_RAWIO",
+	"SYS_BOOT", "NET_ADMIN", "DAC_READ_SEARCH", "MKNOD", "ALL"}
+
+func init_security(data map[interface{}]interface{}) {
+	security := config_section(data, "security")
+	security_read_only = config_bool(security, "read_only_rootfs", security_read_only)
+	if _, ok := security["tmpfs"]; ok {
+		security_tmpfs = config_strings(security, "tmpfs")
+	}
+	security_tmpfs_options = config_string(security, "tmpfs_options", security_tmpfs_options)
+	if _, ok := security["cap_drop"]; ok {
+		security_cap_drop = config_strings(security, "cap_drop")
+	}
+	security_cap_add = config_strings(security, "cap_add")
+	security_no_new_privileges = config_bool(security, "no_new_privileges", security_no_new_privileges)
+	security_pids_limit = int64(config_int(security, "pids_limit", int(security_pids_limit)))
+	security_seccomp = config_string(security, "seccomp_profile", security_seccomp)
+	security_apparmor = config_string(security, "apparmor_profile", security_apparmor)
+
+	// docker expects the content of the seccomp profile, not the filename
+	if security_seccomp != "" && security_seccomp != "unconfined" {
+		content, err := ioutil.ReadFile(security_seccomp)
+		if err != nil {
+			log.Fatalf("Config: can't read seccomp profile (%v)", err)
+		}
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, content); err != nil {
+			log.Fatalf("Config: seccomp profile %s is not valid JSON (%v)", security_seccomp, err)
+		}
+		security_seccomp_json = compact.String()
+	}
+
+	check_security_profile()
+}
+
+// check_security_profile warns about every weakened setting
+func check_security_profile() {
+	var warnings []string
+
+	if !security_read_only {
+		warnings = append(warnings, "root filesystem is writable")
+	}
+	if !contains_string(security_cap_drop, "ALL") {
+		warnings = append(warnings, "not all capabilities are dropped")
+	}
+	for _, capability := range security_cap_add {
+		name := strings.TrimPrefix(strings.ToUpper(capability), "CAP_")
+		if contains_string(dangerous_capabilities, name) {
+			warnings = append(warnings, "dangerous capability "+name+" is added")
+		}
+	}
+	if !security_no_new_privileges {
+		warnings = append(warnings, "no-new-privileges is disabled")
+	}
+	if security_pids_limit <= 0 {
+		warnings = append(warnings, "pids limit is disabled")
+	}
+	if security_seccomp == "unconfined" {
+		warnings = append(warnings, "seccomp is disabled")
+	}
+	if security_apparmor == "unconfined" {
+		warnings = append(warnings, "apparmor is disabled")
+	}
+	if docker_run_as_root {
+		warnings = append(warnings, "containers run with the user of the image")
+	}
+
+	if len(warnings) == 0 {
+		log.Printf("Security profile for user containers is complete!")
+		return
+	}
+	for _, warning := range warnings {
+		log.Printf("WARNING: weakened security profile: %s", warning)
+	}
+}
+
+// apply_security adds the security profile to the host config
+func apply_security(hostConfig *container.HostConfig) {
+	hostConfig.Privileged = false
+	hostConfig.ReadonlyRootfs = security_read_only
+
+	if len(security_tmpfs) > 0 {
+		hostConfig.Tmpfs = make(map[string]string)
+		for _, dir := range security_tmpfs {
+			hostConfig.Tmpfs[dir] = security_tmpfs_options
+		}
+	}
+
+	hostConfig.CapDrop = security_cap_drop
+	hostConfig.CapAdd = security_cap_add
+
+	if security_no_new_privileges {
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "no-new-privileges:true")
+	}
+	if security_seccomp == "unconfined" {
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "seccomp=unconfined")
+	} else if security_seccomp_json != "" {
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "seccomp="+security_seccomp_json)
+	}
+	if security_apparmor != "" {
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "apparmor="+security_apparmor)
+	}
+
+	if security_pids_limit > 0 {
+		limit := security_pids_limit
+		hostConfig.Resources.PidsLimit = &limit
+	}
+}
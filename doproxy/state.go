@@ -0,0 +1,83 @@
+package doproxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// container state helpers
+
+// containers restarted more often are crash looping
+var crash_loop_restarts int = 5
+
+// a restart within this window counts as part of a crash loop
+var crash_loop_window time.Duration = 60 * time.Second
+
+// maximum time to wait for a container to run
+var start_timeout time.Duration = 10 * time.Second
+
+func init_state(data map[interface{}]interface{}) {
+	section := config_section(data, "docker")
+	crash_loop_restarts = config_int(section, "crash_loop_restarts", crash_loop_restarts)
+	crash_loop_window = time.Duration(config_int(section, "crash_loop_window", int(crash_loop_window.Seconds()))) * time.Second
+	start_timeout = time.Duration(config_int(section, "start_timeout", int(start_timeout.Seconds()))) * time.Second
+}
+
+// is_crash_loop checks if docker restarted a container too often in a
+// short time
+func is_crash_loop(data types.ContainerJSON) bool {
+	if data.ContainerJSONBase == nil || data.State == nil || crash_loop_restarts <= 0 {
+		return false
+	}
+	if data.RestartCount < crash_loop_restarts {
+		return false
+	}
+	if data.State.Restarting || data.State.Status == "exited" && data.State.ExitCode != 0 {
+		return true
+	}
+	started, err := time.Parse(time.RFC3339Nano, data.State.StartedAt)
+	return err == nil && time.Since(started) < crash_loop_window
+}
+
+// is_outdated checks if the configuration or the image of a stopped
+// container differs from the current settings
+func is_outdated(data types.ContainerJSON, hash string, image string) bool {
+	if data.Config == nil || data.Config.Labels[label_config_hash] != hash {
+		return true
+	}
+	if data.Config.Image != image {
+		return true
+	}
+	// the image may be pulled again with the same tag
+	if inspect, _, err := docker.ImageInspectWithRaw(context.Background(), image); err == nil {
+		if inspect.ID != data.Image {
+			return true
+		}
+	}
+	return false
+}
+
+// wait_for_running waits until a container is running
+func wait_for_running(container_id string) (types.ContainerJSON, error) {
+	deadline := time.Now().Add(start_timeout)
+	for {
+		data, err := docker.ContainerInspect(context.Background(), container_id)
+		if err != nil {
+			return data, err
+		}
+		if data.State.Running && !data.State.Restarting && !data.State.Paused {
+			return data, nil
+		}
+		if time.Now().After(deadline) {
+			if Debug {
+				log.Printf("Container %s is not running (state: %s)", container_id, data.State.Status)
+			}
+			return data, errors.New("container is not running")
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
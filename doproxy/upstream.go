@@ -0,0 +1,114 @@
+package doproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// upstream resolution
+//
+// the IP address of a container may change after a restart of the
+// container or the docker daemon, the upstream is resolved again on
+// errors, on start events and periodically before requests are
+// forwarded, every resolution verifies that the container still
+// belongs to the user
+
+// use the container name instead of the IP address, docker resolves the
+// names inside of user-defined networks
+var address_by_name bool = false
+
+// seconds between two verifications of an upstream
+var verify_every int = 30
+
+func init_upstream(data map[interface{}]interface{}) {
+	section := config_section(data, "docker")
+	address_by_name = config_bool(section, "address_by_name", address_by_name)
+	verify_every = config_int(section, "verify_every", verify_every)
+
+	if address_by_name && user_network("") == "" {
+		log.Fatalf("Config: address_by_name needs a user-defined network")
+	}
+}
+
+// container_address returns the host part of the upstream url
+func container_address(username string, data types.ContainerJSON) string {
+	if address_by_name && data.ContainerJSONBase != nil {
+		return strings.TrimPrefix(data.Name, "/")
+	}
+	return container_ip(username, data)
+}
+
+// resolve_upstream inspects the container and verifies its identity
+func resolve_upstream(username string, container_id string) (string, error) {
+	data, err := docker.ContainerInspect(context.Background(), container_id)
+	if err != nil {
+		return "", err
+	}
+	if data.Config == nil || data.Config.Labels[label_user] != username ||
+		data.Config.Labels[label_instance] != instance_id {
+		return "", fmt.Errorf("container %s does not belong to '%s'", container_id, username)
+	}
+	if data.State == nil || !data.State.Running || data.State.Paused {
+		return "", errors.New("container is not running")
+	}
+	address := container_address(username, data)
+	if address == "" {
+		return "", errors.New("container has no address")
+	}
+	return fmt.Sprintf("http://%s/", address), nil
+}
+
+// refresh_upstream resolves the upstream of a proxy entry again and
+// replaces the proxy if the address has changed
+func refresh_upstream(username string, pe proxy_service) (proxy_service, error) {
+	url, err := resolve_upstream(username, pe.container_id)
+	if err != nil {
+		return pe, err
+	}
+	if url != pe.url {
+		np, err := NewProxy(url)
+		if err != nil {
+			return pe, err
+		}
+		log.Printf("Upstream of '%s' changed: %s -> %s", username, pe.url, url)
+		pe.url = url
+		pe.proxy = np
+	}
+	pe.verified = time.Now()
+	return pe, nil
+}
+
+// verify_upstream is called before a request is forwarded
+func verify_upstream(username string, pe proxy_service) (proxy_service, error) {
+	if time.Since(pe.verified) < time.Duration(verify_every)*time.Second {
+		return pe, nil
+	}
+	return refresh_upstream(username, pe)
+}
+
+// restart_upstream handles the start events of a container
+func restart_upstream(username string, container_id string) {
+	result, ok := proxies.Load(username)
+	if !ok {
+		return
+	}
+	pe := result.(proxy_service)
+	if pe.container_id != container_id {
+		return
+	}
+	pe, err := refresh_upstream(username, pe)
+	if err != nil {
+		log.Printf("Can't resolve the upstream of '%s' after a start (%v)", username, err)
+		return
+	}
+	pe.ready = true
+	pe.state = state_running
+	pe.reason = ""
+	store_proxy(username, pe)
+}
@@ -0,0 +1,169 @@
+package doproxy
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-co-op/gocron"
+)
+
+// culling windows
+//
+// a window replaces the global idle timeout between its start and end
+// time on the given days, a window may end on the next day (22:00 to
+// 06:00), the first active window wins, profiles with their own
+// cull_timeout are not affected, a window can run the culling more
+// often than the regular culling service
+
+type culling_window struct {
+	name    string
+	start   int // minutes after midnight
+	end     int
+	days    []time.Weekday // the days the window starts, empty means every day
+	timeout int            // in seconds
+	every   int            // in seconds, 0 means the regular culling interval
+}
+
+var culling_windows []culling_window
+var culling_location *time.Location = time.Local
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func init_windows(data map[interface{}]interface{}) {
+	section := config_section(data, "cull")
+
+	zone := config_string(section, "timezone", "Local")
+	location, err := time.LoadLocation(zone)
+	if err != nil {
+		log.Fatalf("Config: unknown timezone '%s' (%v)", zone, err)
+	}
+	culling_location = location
+
+	for i, w := range config_list(section, "windows") {
+		window := culling_window{
+			name:    config_string(w, "name", fmt.Sprintf("window%d", i+1)),
+			timeout: config_int(w, "timeout", 0),
+			every:   config_int(w, "every", 0),
+		}
+		window.start = parse_clock(window.name, config_string(w, "start", ""))
+		window.end = parse_clock(window.name, config_string(w, "end", ""))
+		for _, day := range config_strings(w, "days") {
+			name := strings.ToLower(day)
+			if len(name) > 3 {
+				name = name[:3]
+			}
+			weekday, ok := weekdays[name]
+			if !ok {
+				log.Fatalf("Config: unknown day '%s' in culling window '%s'", day, window.name)
+			}
+			window.days = append(window.days, weekday)
+		}
+		if window.timeout <= 0 {
+			log.Fatalf("Config: culling window '%s' needs a timeout", window.name)
+		}
+		log.Printf("Culling window '%s': %02d:%02d-%02d:%02d %v timeout=%ds every=%ds (%s)",
+			window.name, window.start/60, window.start%60, window.end/60, window.end%60,
+			window.days, window.timeout, window.every, culling_location)
+		culling_windows = append(culling_windows, window)
+	}
+}
+
+// parse_clock reads a time like 22:00 as minutes after midnight
+func parse_clock(name string, clock string) int {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		log.Fatalf("Config: invalid time '%s' in culling window '%s', use \"hh:mm\"", clock, name)
+	}
+	return t.Hour()*60 + t.Minute()
+}
+
+func (window culling_window) on_day(day time.Weekday) bool {
+	return len(window.days) == 0 || contains_weekday(window.days, day)
+}
+
+func contains_weekday(list []time.Weekday, day time.Weekday) bool {
+	for _, d := range list {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// active checks if the window covers a point in time
+func (window culling_window) active(now time.Time) bool {
+	now = now.In(culling_location)
+	minutes := now.Hour()*60 + now.Minute()
+	if window.start <= window.end {
+		return window.on_day(now.Weekday()) && minutes >= window.start && minutes < window.end
+	}
+	// the window ends on the next day
+	yesterday := (now.Weekday() + 6) % 7
+	return (window.on_day(now.Weekday()) && minutes >= window.start) ||
+		(window.on_day(yesterday) && minutes < window.end)
+}
+
+// active_window returns the first active culling window
+func active_window() (culling_window, bool) {
+	now := time.Now()
+	for _, window := range culling_windows {
+		if window.active(now) {
+			return window, true
+		}
+	}
+	return culling_window{}, false
+}
+
+// culling_timeout returns the idle timeout of a proxy entry
+func culling_timeout(pe proxy_service) int {
+	if pe.cull_timeout > 0 {
+		return pe.cull_timeout
+	}
+	if window, ok := active_window(); ok {
+		return window.timeout
+	}
+	return Culling_timeout
+}
+
+// cron_days converts the days of a window into the day of week field
+func (window culling_window) cron_days() string {
+	if len(window.days) == 0 {
+		return "*"
+	}
+	var days []string
+	for _, day := range window.days {
+		days = append(days, fmt.Sprintf("%d", day))
+	}
+	return strings.Join(days, ",")
+}
+
+// window_culling runs the culling, if the window is active
+func window_culling(window culling_window) {
+	if window.active(time.Now()) {
+		Service_culling()
+	}
+}
+
+// Schedule_culling_windows
+//
+// adds the jobs of the culling windows to the scheduler, the culling
+// runs at the start of every window and in the interval of the window
+func Schedule_culling_windows(s *gocron.Scheduler) {
+	for _, window := range culling_windows {
+		expression := fmt.Sprintf("CRON_TZ=%s %d %d * * %s",
+			culling_location, window.start%60, window.start/60, window.cron_days())
+		if _, err := s.Cron(expression).Do(Service_culling); err != nil {
+			log.Fatalf("Can't schedule culling window '%s' (%v)", window.name, err)
+		}
+		if window.every > 0 {
+			if _, err := s.Every(window.every).Seconds().Do(window_culling, window); err != nil {
+				log.Fatalf("Can't schedule culling window '%s' (%v)", window.name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package doproxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCullingWindowActive(t *testing.T) {
+	old := culling_location
+	t.Cleanup(func() { culling_location = old })
+	culling_location = time.UTC
+
+	night := culling_window{name: "night", start: 22 * 60, end: 6 * 60}
+	weekend_night := culling_window{name: "weekend", start: 22 * 60, end: 6 * 60,
+		days: []time.Weekday{time.Saturday}}
+	lectures := culling_window{name: "lectures", start: 8 * 60, end: 18 * 60,
+		days: []time.Weekday{time.Monday, time.Friday}}
+
+	// 2024-01-01 was a monday
+	at := func(day int, hour int, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		window culling_window
+		now    time.Time
+		want   bool
+	}{
+		{night, at(1, 23, 0), true},
+		{night, at(1, 5, 59), true},
+		{night, at(1, 6, 0), false},
+		{night, at(1, 21, 59), false},
+		{night, at(1, 22, 0), true},
+		{weekend_night, at(6, 23, 0), true},  // saturday evening
+		{weekend_night, at(7, 3, 0), true},   // sunday morning
+		{weekend_night, at(7, 23, 0), false}, // sunday evening
+		{weekend_night, at(6, 3, 0), false},  // saturday morning
+		{lectures, at(1, 8, 0), true},
+		{lectures, at(1, 18, 0), false},
+		{lectures, at(2, 12, 0), false},
+		{lectures, at(5, 12, 0), true},
+	}
+	for _, tt := range tests {
+		if got := tt.window.active(tt.now); got != tt.want {
+			t.Errorf("%s.active(%v) = %v, want %v", tt.window.name, tt.now, got, tt.want)
+		}
+	}
+}
@@ -22,22 +22,61 @@ func main() {
 	doproxy.Init_doproxy()
 	pingpong.Set_version(version)
 
+	// adopt the containers of a previous run
+	doproxy.Service_reconcile()
+
+	s := gocron.NewScheduler(time.UTC)
+
 	if doproxy.Culling {
 		// setup the background culling service, if enabled
-		s := gocron.NewScheduler(time.UTC)
 		log.Printf("Setup a culling service every %v seconds...", doproxy.Culling_every)
 		st := time.Now().Add(time.Second * time.Duration(doproxy.Culling_every))
 		s.Every(doproxy.Culling_every).Seconds().StartAt(st).Do(doproxy.Service_culling)
 		st = time.Now().Add(time.Second * 600)
 		s.Every(3600).Seconds().StartAt(st).Do(doproxy.Service_deep_culling)
+		// the time-of-day windows with their own timeouts
+		doproxy.Schedule_culling_windows(s)
+	}
+
+	if doproxy.Pressure {
+		// setup the culling service for host memory pressure, if enabled
+		log.Printf("Setup a pressure culling service every %v seconds...", doproxy.Pressure_every)
+		s.Every(doproxy.Pressure_every).Seconds().Do(doproxy.Service_pressure_culling)
+	}
+
+	if doproxy.Prewarm {
+		// setup the pre-warming of popular sites, if enabled
+		log.Printf("Setup a pre-warming service every %v seconds...", doproxy.Prewarm_every)
+		doproxy.Schedule_prewarm(s)
+	}
 
-		// start the backgroud scheduler
-		s.StartAsync()
+	if doproxy.History {
+		// save the access history periodically, if a history_file is set
+		log.Printf("Setup a history service every %v seconds...", doproxy.Prewarm_every)
+		s.Every(doproxy.Prewarm_every).Seconds().Do(doproxy.Service_history)
 	}
 
+	if doproxy.Pool {
+		// setup the warm pool, if enabled
+		log.Printf("Setup a warm pool service every %v seconds...", doproxy.Pool_every)
+		s.Every(doproxy.Pool_every).Seconds().Do(doproxy.Service_pool)
+	}
+
+	// start the backgroud scheduler
+	s.StartAsync()
+
+	// watch the docker events of the user containers
+	go doproxy.Service_events()
+
+	// start the pinned sites
+	go doproxy.Service_pinned()
+
 	// handle all requests to your server using the proxy
 	http.HandleFunc("/", doproxy.Handle_proxy_request)
 
+	// admin requests
+	http.HandleFunc("/hrp/", doproxy.Handle_admin_request)
+
 	// add pingpong for health checks
 	http.HandleFunc("/ping", pingpong.Handle_ping_request)
 